@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+)
+
+// The address index lists, for every pubKeyHash, the main chain transactions
+// that pay to it or spend from it. Keys are the length-prefixed pubKeyHash,
+// height and txid, so the history of an address is a range of keys ordered
+// by height that no other address shares a prefix with; values are
+// the hash of the block holding the transaction. Like the transaction index
+// it is optional and kept up to date once built with ReindexAddresses.
+const addrIndexBucket = "addrindex"
+
+var errNoAddrIndex = errors.New("Address index is not built, run service -addrindex first")
+
+// AddressEvent is a transaction in the history of an address
+type AddressEvent struct {
+	Height    int
+	TxID      []byte
+	BlockHash []byte
+}
+
+// ReindexAddresses builds the address index from the main chain, replacing
+// the one there is. It returns the number of indexed entries.
+func (bc *Blockchain) ReindexAddresses() int {
+	bucketName := []byte(addrIndexBucket)
+
+	err := bc.DB.Update(func(tx StorageTx) error {
+		err := tx.DeleteBucket(bucketName)
+		if err != nil && err != errBucketNotFound {
+			log.Panic(err)
+		}
+
+		_, err = tx.CreateBucket(bucketName)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		b := tx.Bucket([]byte(blocksBucket))
+		hash := bc.tip
+		for {
+			block := DeserializeBlock(b.Get(hash))
+			hash = block.PrevBlockHash
+
+			indexAddresses(tx, block)
+
+			if len(block.PrevBlockHash) == 0 {
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	count := 0
+	err = bc.DB.View(func(tx StorageTx) error {
+		c := tx.Bucket(bucketName).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			count++
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return count
+}
+
+// AddressHistory returns the transactions of an address, newest first,
+// skipping offset of them and returning at most limit. It also returns how
+// many transactions the address has in total.
+func (bc *Blockchain) AddressHistory(pubKeyHash []byte, offset, limit int) ([]AddressEvent, int, error) {
+	var events []AddressEvent
+	total := 0
+
+	err := bc.DB.View(func(tx StorageTx) error {
+		ab := tx.Bucket([]byte(addrIndexBucket))
+		if ab == nil {
+			return errNoAddrIndex
+		}
+
+		prefix := appendBytes(nil, pubKeyHash)
+		c := ab.Cursor()
+		k, v := c.Seek(addrIndexKey(pubKeyHash, -1, nil))
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Prev() {
+			if total >= offset && len(events) < limit {
+				height := int(binary.BigEndian.Uint64(k[len(prefix):]))
+				txID := append([]byte{}, k[len(prefix)+8:]...)
+				events = append(events, AddressEvent{height, txID, append([]byte{}, v...)})
+			}
+			total++
+		}
+
+		return nil
+	})
+
+	return events, total, err
+}
+
+// AddressAmounts returns what a transaction pays to an address and what it
+// spends from it
+func (bc *Blockchain) AddressAmounts(transaction *Transaction, pubKeyHash []byte) (received, sent int) {
+	for _, out := range transaction.Vout {
+		if out.IsLockedWithKey(pubKeyHash) {
+			received += out.Value
+		}
+	}
+
+	if transaction.IsCoinbase() {
+		return received, sent
+	}
+
+	for _, vin := range transaction.Vin {
+		if !vin.UsesKey(pubKeyHash) {
+			continue
+		}
+
+		prevTX, err := bc.FindTransaction(vin.Txid)
+		if err != nil {
+			log.Panic(err)
+		}
+		sent += prevTX.Vout[vin.Vout].Value
+	}
+
+	return received, sent
+}
+
+// indexAddresses adds the transactions of a block joining the main chain to
+// the address index, if there is one
+func indexAddresses(tx StorageTx, block *Block) {
+	ab := tx.Bucket([]byte(addrIndexBucket))
+	if ab == nil {
+		return
+	}
+
+	for _, transaction := range block.Transactions {
+		for _, pubKeyHash := range transactionAddresses(transaction) {
+			err := ab.Put(addrIndexKey(pubKeyHash, block.Height, transaction.ID), block.Hash)
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+	}
+}
+
+// unindexAddresses removes the transactions of a block leaving the main chain
+// from the address index, if there is one
+func unindexAddresses(tx StorageTx, block *Block) {
+	ab := tx.Bucket([]byte(addrIndexBucket))
+	if ab == nil {
+		return
+	}
+
+	for _, transaction := range block.Transactions {
+		for _, pubKeyHash := range transactionAddresses(transaction) {
+			err := ab.Delete(addrIndexKey(pubKeyHash, block.Height, transaction.ID))
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+	}
+}
+
+// transactionAddresses returns the pubKeyHashes a transaction pays to or
+// spends from, each once
+func transactionAddresses(transaction *Transaction) [][]byte {
+	var addresses [][]byte
+	seen := make(map[string]bool)
+
+	add := func(pubKeyHash []byte) {
+		if !seen[string(pubKeyHash)] {
+			seen[string(pubKeyHash)] = true
+			addresses = append(addresses, pubKeyHash)
+		}
+	}
+
+	if !transaction.IsCoinbase() {
+		for _, vin := range transaction.Vin {
+			add(HashPubKey(vin.PubKey))
+		}
+	}
+	for _, out := range transaction.Vout {
+		add(out.PubKeyHash)
+	}
+
+	return addresses
+}
+
+// addrIndexKey returns the address index key of a transaction at height. A
+// height of -1 gives a key sorting after every other key of the address.
+func addrIndexKey(pubKeyHash []byte, height int, txID []byte) []byte {
+	key := appendBytes(nil, pubKeyHash)
+	key = binary.BigEndian.AppendUint64(key, uint64(height))
+
+	return append(key, txID...)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAddressHistory(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, c *testChain, spend *Transaction, miner string)
+		sender []int // heights of the history of the genesis allocation, newest first
+		payee  []int
+	}{
+		{"connected blocks", nil, []int{1, 0}, []int{1}},
+		{"disconnected tip", func(t *testing.T, c *testChain, spend *Transaction, miner string) {
+			c.bc.disconnectTip()
+		}, []int{1, 0}, []int{1}},
+		{"disconnected spend", func(t *testing.T, c *testChain, spend *Transaction, miner string) {
+			c.bc.disconnectTip()
+			c.bc.disconnectTip()
+		}, []int{0}, nil},
+		{"reorganized away", func(t *testing.T, c *testChain, spend *Transaction, miner string) {
+			block := GetGenesisBlock()
+			for i := 0; i < 3; i++ {
+				block = c.newBlock(block, miner)
+				c.add(block)
+			}
+		}, []int{0}, nil},
+		{"reorganized to a higher block", func(t *testing.T, c *testChain, spend *Transaction, miner string) {
+			block := c.newBlock(GetGenesisBlock(), miner)
+			c.add(block)
+			block = c.newBlock(block, miner, spend)
+			c.add(block)
+			c.add(c.newBlock(block, miner))
+		}, []int{2, 0}, []int{2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "addrindex")
+			c.bc.ReindexAddresses()
+			_, miner := newTestWallet()
+			_, payee := newTestWallet()
+			spend := c.send(testWallet, payee, 3, 0)
+			c.mine(miner, spend)
+			c.mine(miner)
+			if tt.change != nil {
+				tt.change(t, c, spend, miner)
+			}
+
+			checkHistory(t, c, addressPubKeyHash(string(testWallet.GetAddress())), tt.sender)
+			checkHistory(t, c, addressPubKeyHash(payee), tt.payee)
+		})
+	}
+}
+
+func TestAddressHistoryOfLongerAddress(t *testing.T) {
+	c := newTestChain(t, "addrindex")
+	c.bc.ReindexAddresses()
+	_, miner := newTestWallet()
+	wallet, payee := newTestWallet()
+	c.mine(miner, c.send(testWallet, payee, 3, 0))
+
+	// An address starting with the pubKeyHash of payee and the bytes of a
+	// height does not show in the history of payee
+	longer := append(addressPubKeyHash(payee), heightKey(1)...)
+	tx := c.send(wallet, payee, 1, 0)
+	tx.Vout[0].PubKeyHash = longer
+	resign(c, tx, wallet)
+	c.mine(miner, tx)
+
+	checkHistory(t, c, addressPubKeyHash(payee), []int{2, 1})
+	checkHistory(t, c, longer, []int{2})
+}
+
+// checkHistory checks the heights of the address history of pubKeyHash and
+// that its transactions are in the blocks the history names
+func checkHistory(t *testing.T, c *testChain, pubKeyHash []byte, heights []int) {
+	t.Helper()
+
+	events, total, err := c.bc.AddressHistory(pubKeyHash, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != len(heights) || len(events) != len(heights) {
+		t.Fatalf("History of %x has %d transactions, want %d", pubKeyHash, total, len(heights))
+	}
+	for i, event := range events {
+		if event.Height != heights[i] {
+			t.Errorf("Transaction %d of %x is at height %d, want %d", i, pubKeyHash, event.Height, heights[i])
+		}
+		block := blockAt(t, c, event.Height)
+		if !bytes.Equal(block.Hash, event.BlockHash) {
+			t.Errorf("Transaction %d of %x is in block %x, not on the main chain", i, pubKeyHash, event.BlockHash)
+		}
+		found := false
+		for _, tx := range block.Transactions {
+			found = found || bytes.Equal(tx.ID, event.TxID)
+		}
+		if !found {
+			t.Errorf("Transaction %x is not in block %x", event.TxID, block.Hash)
+		}
+	}
+}
@@ -2,26 +2,45 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"log"
 	"os"
 	"time"
 )
 
-// Block represents a block in the blockchain
-type Block struct {
-	Timestamp     int64
-	Transactions  []*Transaction
+const blockVersion = 1
+const headerLength = 4 + 32 + 32 + 8 + 4 + 8
+
+// BlockHeader holds the fields of a block covered by its proof of work
+type BlockHeader struct {
+	Version       int32
 	PrevBlockHash []byte
-	Hash          []byte
+	MerkleRoot    []byte
+	Timestamp     int64
+	Bits          uint32
 	Nonce         int
-	Height        int
 }
 
-// NewBlock creates and returns Block
-func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), transactions, prevBlockHash, []byte{}, 0, height}
+// Block represents a block in the blockchain
+type Block struct {
+	BlockHeader
+	Transactions []*Transaction
+	Hash         []byte
+	Height       int
+}
+
+// NewBlock creates and returns Block stamped with timestamp and mined
+// against the target in bits
+func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int, bits uint32, timestamp int64) *Block {
+	block := &Block{
+		BlockHeader{blockVersion, prevBlockHash, nil, timestamp, bits, 0},
+		transactions, []byte{}, height,
+	}
+	block.MerkleRoot = block.HashTransactions()
+
 	pow := NewProofOfWork(block)
 	nonce, hash := pow.Run()
 
@@ -31,9 +50,44 @@ func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int) *Bl
 	return block
 }
 
+// Serialize encodes the header in a fixed layout; the block hash is the
+// hash of these bytes
+func (h *BlockHeader) Serialize() []byte {
+	data := make([]byte, headerLength)
+
+	binary.BigEndian.PutUint32(data[0:], uint32(h.Version))
+	copy(data[4:36], h.PrevBlockHash)
+	copy(data[36:68], h.MerkleRoot)
+	binary.BigEndian.PutUint64(data[68:], uint64(h.Timestamp))
+	binary.BigEndian.PutUint32(data[76:], h.Bits)
+	binary.BigEndian.PutUint64(data[80:], uint64(h.Nonce))
+
+	return data
+}
+
+// DeserializeHeader decodes a header encoded by BlockHeader.Serialize
+func DeserializeHeader(d []byte) (*BlockHeader, error) {
+	if len(d) != headerLength {
+		return nil, errors.New("Header has a wrong length")
+	}
+
+	h := BlockHeader{
+		Version:    int32(binary.BigEndian.Uint32(d[0:])),
+		MerkleRoot: append([]byte{}, d[36:68]...),
+		Timestamp:  int64(binary.BigEndian.Uint64(d[68:])),
+		Bits:       binary.BigEndian.Uint32(d[76:]),
+		Nonce:      int(binary.BigEndian.Uint64(d[80:])),
+	}
+	if !bytes.Equal(d[4:36], make([]byte, 32)) {
+		h.PrevBlockHash = append([]byte{}, d[4:36]...)
+	}
+
+	return &h, nil
+}
+
 // NewGenesisBlock creates and returns genesis Block
 func NewGenesisBlock(coinbase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinbase}, []byte{}, 0)
+	return NewBlock([]*Transaction{coinbase}, []byte{}, 0, BigToCompact(activeNetParams.PowLimit), time.Now().Unix())
 }
 
 // HashTransactions returns a hash of the transactions in the block
@@ -41,7 +95,7 @@ func (b *Block) HashTransactions() []byte {
 	var transactions [][]byte
 
 	for _, tx := range b.Transactions {
-		transactions = append(transactions, tx.Serialize())
+		transactions = append(transactions, tx.hashData())
 	}
 	mTree := NewMerkleTree(transactions)
 
@@ -63,15 +117,23 @@ func (b *Block) Serialize() []byte {
 
 // DeserializeBlock deserializes a block
 func DeserializeBlock(d []byte) *Block {
+	block, err := decodeBlock(d)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return block
+}
+
+// decodeBlock deserializes a block that may be malformed, such as one read
+// from a file
+func decodeBlock(d []byte) (*Block, error) {
 	var block Block
 
 	decoder := gob.NewDecoder(bytes.NewReader(d))
 	err := decoder.Decode(&block)
-	if err != nil {
-		log.Panic(err)
-	}
 
-	return &block
+	return &block, err
 }
 
 func (block Block) SaveToFile(filename string) {
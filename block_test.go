@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHeaderSerialization(t *testing.T) {
+	tests := []struct {
+		name   string
+		header BlockHeader
+	}{
+		{"genesis", BlockHeader{blockVersion, nil, bytes.Repeat([]byte{1}, 32), 1700000000, 0x1f010000, 42}},
+		{"block", BlockHeader{blockVersion, bytes.Repeat([]byte{2}, 32), bytes.Repeat([]byte{3}, 32), 1700000600, 0x1e00ffff, 1 << 40}},
+	}
+
+	for _, tt := range tests {
+		data := tt.header.Serialize()
+		if len(data) != headerLength {
+			t.Fatalf("%s: header is %d bytes", tt.name, len(data))
+		}
+
+		got, err := DeserializeHeader(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Serialize(), data) || !bytes.Equal(got.PrevBlockHash, tt.header.PrevBlockHash) {
+			t.Errorf("%s: got %+v back, want %+v", tt.name, *got, tt.header)
+		}
+	}
+
+	if _, err := DeserializeHeader(make([]byte, headerLength-1)); err == nil {
+		t.Error("Short header decoded")
+	}
+}
+
+// Blocks changed without changing their hash have to be rejected all the same
+func TestValidateBlockRejectsMalleatedBlocks(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(block *Block)
+		err    string
+	}{
+		{"repeated last transaction", func(block *Block) {
+			block.Transactions = append(block.Transactions, block.Transactions[len(block.Transactions)-1])
+		}, "appears twice"},
+		{"long previous block hash", func(block *Block) {
+			block.PrevBlockHash = append(block.PrevBlockHash, 0)
+		}, "32 bytes"},
+		{"long Merkle root", func(block *Block) {
+			block.MerkleRoot = append(block.MerkleRoot, 0)
+		}, "32 bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "malleated")
+			x, xAddress := newTestWallet()
+			_, miner := newTestWallet()
+			c.mine(miner, c.send(testWallet, xAddress, 7, 0))
+
+			// An odd number of transactions, so the last one is paired with
+			// itself in the Merkle tree
+			block := c.newBlock(c.tip(), miner, c.send(x, miner, 3, 0), c.send(testWallet, miner, 1, 0))
+			changed := *block
+			changed.Transactions = append([]*Transaction{}, block.Transactions...)
+			tt.change(&changed)
+
+			if !bytes.Equal(changed.HashTransactions(), block.MerkleRoot) || !NewProofOfWork(&changed).Validate() {
+				t.Fatal("Change altered the block hash")
+			}
+			if err := c.bc.ValidateBlock(&changed); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Changed block: %v", err)
+			}
+			c.add(block)
+		})
+	}
+}
@@ -3,53 +3,54 @@ package main
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/big"
 	"os"
-
-	"github.com/boltdb/bolt"
+	"sort"
+	"sync"
 )
 
 const dbFile = "blockchain_%s.db"
 const blocksBucket = "blocks"
-const genesisCoinbaseData = "Create block chain mannually according to Fuda MSE Project"
+const chainworkBucket = "chainwork"
+const heightBucket = "heights"
+const blockReservedSize = 1000 // room for the header and coinbase of a new block
 
 // const genesisBlockFile = "genesis.blk"
-const genesisBlockData = "63ff8903010105426c6f636b01ff8a000106010954696d657374616d70010400010c5472616e73616374696f6e7301ff8c00010d50726576426c6f636b48617368010a00010448617368010a0001054e6f6e63650104000106486569676874010400000022ff8b020101135b5d2a6d61696e2e5472616e73616374696f6e01ff8c0001ff800000327f0301010b5472616e73616374696f6e01ff8000010301024944010a00010356696e01ff84000104566f757401ff880000001dff830201010e5b5d6d61696e2e5458496e70757401ff840001ff82000040ff81030101075458496e70757401ff82000104010454786964010a000104566f757401040001095369676e6174757265010a0001065075624b6579010a0000001eff870201010f5b5d6d61696e2e54584f757470757401ff880001ff8600002fff850301010854584f757470757401ff86000102010556616c7565010400010a5075624b657948617368010a000000ffb1ff8a01fccee1eb1801010120a7b3ddf2cf5658d10d126a73ee74d7b84a04d8c94d0854ed19e113c2afa5c49d01010201023a43726561746520626c6f636b20636861696e206d616e6e75616c6c79206163636f7264696e6720746f2046756461204d53452050726f6a656374000101011401144e190c9afd4c7bcb1f09e8263a26ea49e49ced310000022000002b40928246808d0b7fe186b63ddb36659e047800b76012d65327be8adad001fd013a5a00"
-
-var centerWallets = GetCenterWallets()
 
-var genesisAddress = centerWallets.GetAddresses()[0]
+// The genesis blocks of the built-in networks pay their allocation to a
+// public key hash of zeros, which no key hashes to, so it can never be spent
+const mainNetGenesisBlockData = "497f03010105426c6f636b01ff80000104010b426c6f636b48656164657201ff8200010c5472616e73616374696f6e7301ff8e00010448617368010a000106486569676874010400000067ff810301010b426c6f636b48656164657201ff82000106010756657273696f6e010400010d50726576426c6f636b48617368010a00010a4d65726b6c65526f6f74010a00010954696d657374616d7001040001044269747301060001054e6f6e6365010400000022ff8d020101135b5d2a6d61696e2e5472616e73616374696f6e01ff8e0001ff84000026ff83030102ff8400010301024944010a00010356696e01ff88000104566f757401ff8c0000001dff870201010e5b5d6d61696e2e5458496e70757401ff880001ff86000040ff85030101075458496e70757401ff86000104010454786964010a000104566f757401040001095369676e6174757265010a0001065075624b6579010a0000001eff8b0201010f5b5d6d61696e2e54584f757470757401ff8c0001ff8a00002fff890301010854584f757470757401ff8a000102010556616c7565010400010a5075624b657948617368010a000000ffdcff80010102022088f17bc323bc7a1094036348917474cdfad5892de2f928d08162f56205f3db4901fccee1eb1801fc1f01000001fea5120001010120fd43156f34f2a0350d6dd5082dd7d5f68aeb4e497651f430fa1b9f16f4aaf4fd01010201023a43726561746520626c6f636b20636861696e206d616e6e75616c6c79206163636f7264696e6720746f2046756461204d53452050726f6a65637400010101140114000000000000000000000000000000000000000000000120000063ddc03566999e0a77f855032077b8660612f08cadf16bfedc6d61e1176d00"
+const testNetGenesisBlockData = "497f03010105426c6f636b01ff80000104010b426c6f636b48656164657201ff8200010c5472616e73616374696f6e7301ff8e00010448617368010a000106486569676874010400000067ff810301010b426c6f636b48656164657201ff82000106010756657273696f6e010400010d50726576426c6f636b48617368010a00010a4d65726b6c65526f6f74010a00010954696d657374616d7001040001044269747301060001054e6f6e6365010400000022ff8d020101135b5d2a6d61696e2e5472616e73616374696f6e01ff8e0001ff84000026ff83030102ff8400010301024944010a00010356696e01ff88000104566f757401ff8c0000001dff870201010e5b5d6d61696e2e5458496e70757401ff880001ff86000040ff85030101075458496e70757401ff86000104010454786964010a000104566f757401040001095369676e6174757265010a0001065075624b6579010a0000001eff8b0201010f5b5d6d61696e2e54584f757470757401ff8c0001ff8a00002fff890301010854584f757470757401ff8a000102010556616c7565010400010a5075624b657948617368010a000000ffddff80010102022088f17bc323bc7a1094036348917474cdfad5892de2f928d08162f56205f3db4901fcd5a936ee01fc1f01000001fd047d100001010120fd43156f34f2a0350d6dd5082dd7d5f68aeb4e497651f430fa1b9f16f4aaf4fd01010201023a43726561746520626c6f636b20636861696e206d616e6e75616c6c79206163636f7264696e6720746f2046756461204d53452050726f6a656374000101011401140000000000000000000000000000000000000000000001200000280f144f6217ac0ebe66235baf5384a19d49b1a2ff6ded4caf7faf04bfc600"
+const regTestGenesisBlockData = "497f03010105426c6f636b01ff80000104010b426c6f636b48656164657201ff8200010c5472616e73616374696f6e7301ff8e00010448617368010a000106486569676874010400000067ff810301010b426c6f636b48656164657201ff82000106010756657273696f6e010400010d50726576426c6f636b48617368010a00010a4d65726b6c65526f6f74010a00010954696d657374616d7001040001044269747301060001054e6f6e6365010400000022ff8d020101135b5d2a6d61696e2e5472616e73616374696f6e01ff8e0001ff84000026ff83030102ff8400010301024944010a00010356696e01ff88000104566f757401ff8c0000001dff870201010e5b5d6d61696e2e5458496e70757401ff880001ff86000040ff85030101075458496e70757401ff86000104010454786964010a000104566f757401040001095369676e6174757265010a0001065075624b6579010a0000001eff8b0201010f5b5d6d61696e2e54584f757470757401ff8c0001ff8a00002fff890301010854584f757470757401ff8a000102010556616c7565010400010a5075624b657948617368010a000000ffdbff80010102022088f17bc323bc7a1094036348917474cdfad5892de2f928d08162f56205f3db4901fcd5a936ee01fc2001000001ff8c0001010120fd43156f34f2a0350d6dd5082dd7d5f68aeb4e497651f430fa1b9f16f4aaf4fd01010201023a43726561746520626c6f636b20636861696e206d616e6e75616c6c79206163636f7264696e6720746f2046756461204d53452050726f6a6563740001010114011400000000000000000000000000000000000000000000012000cd56cb6dfc36c8d28366fd6957b055ed019ddbe5a6556e8f08c5df1cec6a9300"
 
-// Blockchain implements interactions with a DB
+// Blockchain implements interactions with a Storage
 type Blockchain struct {
-	tip []byte
-	DB  *bolt.DB
+	tip        []byte
+	DB         Storage
+	pruneDepth int        // 0 keeps every block
+	lock       sync.Mutex // held by connections adding or mining blocks
+	progress   io.Writer  // where upgrading and repairing it is reported
 }
 
 func GetDbName(nodeID string) string {
-	return fmt.Sprintf(dbFile, nodeID)
+	return dataFile(dbFile, nodeID)
 }
 
 func CreateGenesisIfNeeded(nodeID string) {
-	if !dbExists(GetDbName(nodeID)) {
+	if !storageExists(GetDbName(nodeID)) {
 		bc := CreateBlockchain(nodeID)
 		defer bc.DB.Close()
 
-		UTXOSet := UTXOSet{bc}
-		UTXOSet.Reindex()
-
 		fmt.Println("Done!")
 	}
 }
 
-func CreateGenesisBlock() *Block {
-	cbtx := NewCoinbaseTX(genesisAddress, genesisCoinbaseData)
-	return NewGenesisBlock(cbtx)
-}
-
 // func GetGenesisBlock() *Block {
 // 	if _, err := os.Stat(genesisBlockFile); errors.Is(err, os.ErrNotExist) {
 // 		genesis := CreateGenesisBlock()
@@ -64,7 +65,7 @@ func CreateGenesisBlock() *Block {
 
 func GetGenesisBlock() *Block {
 	gensis := Block{}
-	if err := gensis.LoadFromHex(genesisBlockData); err != nil {
+	if err := gensis.LoadFromHex(activeNetParams.GenesisBlockData); err != nil {
 		log.Panic(err)
 	}
 	return &gensis
@@ -72,37 +73,39 @@ func GetGenesisBlock() *Block {
 
 // CreateBlockchain creates a new blockchain DB
 func CreateBlockchain(nodeID string) *Blockchain {
-	dbFile := fmt.Sprintf(dbFile, nodeID)
-	if dbExists(dbFile) {
+	return createBlockchainAt(GetDbName(nodeID))
+}
+
+func createBlockchainAt(dbFile string) *Blockchain {
+	if storageExists(dbFile) {
 		fmt.Println("Blockchain already exists.")
 		os.Exit(1)
 	}
 
-	var tip []byte
-
 	genesis := GetGenesisBlock()
 
-	db, err := bolt.Open(dbFile, 0600, nil)
+	db, err := OpenStorage(dbFile)
 	if err != nil {
 		log.Panic(err)
 	}
+	bc := Blockchain{DB: db, progress: os.Stdout}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucket([]byte(blocksBucket))
-		if err != nil {
-			log.Panic(err)
+	err = db.Update(func(tx StorageTx) error {
+		for _, bucket := range []string{blocksBucket, chainworkBucket, heightBucket, utxoBucket} {
+			_, err := tx.CreateBucket([]byte(bucket))
+			if err != nil {
+				log.Panic(err)
+			}
 		}
 
-		err = b.Put(genesis.Hash, genesis.Serialize())
+		err := tx.Bucket([]byte(blocksBucket)).Put(genesis.Hash, genesis.Serialize())
 		if err != nil {
 			log.Panic(err)
 		}
 
-		err = b.Put([]byte("l"), genesis.Hash)
-		if err != nil {
-			log.Panic(err)
-		}
-		tip = genesis.Hash
+		putChainWork(tx, genesis)
+		bc.connectBlock(tx, genesis)
+		putMeta(tx, schemaVersion)
 
 		return nil
 	})
@@ -110,28 +113,36 @@ func CreateBlockchain(nodeID string) *Blockchain {
 		log.Panic(err)
 	}
 
-	bc := Blockchain{tip, db}
-
 	return &bc
 }
 
 // NewBlockchain creates a new Blockchain with genesis Block
 func NewBlockchain(nodeID string) *Blockchain {
-	dbFile := fmt.Sprintf(dbFile, nodeID)
-	if !dbExists(dbFile) {
-		fmt.Println("No existing blockchain found. Create one first.")
+	return openBlockchain(GetDbName(nodeID), os.Stdout)
+}
+
+// openBlockchain opens the blockchain at dbFile, upgrading and repairing it
+// when needed and reporting that to progress
+func openBlockchain(dbFile string, progress io.Writer) *Blockchain {
+	if !storageExists(dbFile) {
+		fmt.Fprintln(progress, "No existing blockchain found. Create one first.")
 		os.Exit(1)
 	}
 
 	var tip []byte
-	db, err := bolt.Open(dbFile, 0600, nil)
+	db, err := OpenStorage(dbFile)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
+	db, err = upgradeStorage(dbFile, db, progress)
+	if err != nil {
+		fmt.Fprintln(progress, err)
+		os.Exit(1)
+	}
+
+	err = db.View(func(tx StorageTx) error {
+		tip = append([]byte{}, tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))...)
 
 		return nil
 	})
@@ -139,14 +150,120 @@ func NewBlockchain(nodeID string) *Blockchain {
 		log.Panic(err)
 	}
 
-	bc := Blockchain{tip, db}
+	bc := Blockchain{tip: tip, DB: db, progress: progress}
+	err = bc.checkChainstate()
+	if err == nil {
+		err = bc.checkSnapshot()
+	}
+	if err != nil {
+		fmt.Fprintln(progress, err)
+		os.Exit(1)
+	}
 
 	return &bc
 }
 
-// AddBlock saves the block into the blockchain
-func (bc *Blockchain) AddBlock(block *Block) {
-	err := bc.DB.Update(func(tx *bolt.Tx) error {
+// openBlockchainReadOnly opens the blockchain at dbFile as it is stored: the
+// database is neither upgraded nor is its chainstate repaired, and every
+// write fails
+func openBlockchainReadOnly(dbFile string) (*Blockchain, error) {
+	if !storageExists(dbFile) {
+		return nil, errors.New("No existing blockchain found. Create one first.")
+	}
+
+	db, err := OpenStorage(dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	version, network, genesis := readMeta(db)
+	if version == 0 {
+		err = incompatibleRelease(dbFile)
+	} else if !bytes.Equal(genesis, GetGenesisBlock().Hash) {
+		err = fmt.Errorf("Database %s is for network %s, not %s", dbFile, network, activeNetParams.Name)
+	} else if version != schemaVersion {
+		err = fmt.Errorf("Database %s has schema version %d, not %d. Open it with another command to upgrade it first", dbFile, version, schemaVersion)
+	}
+
+	var tip []byte
+	if err == nil {
+		err = db.View(func(tx StorageTx) error {
+			b := tx.Bucket([]byte(blocksBucket))
+			if b == nil || b.Get([]byte("l")) == nil || tx.Bucket([]byte(heightBucket)) == nil {
+				return errors.New("Blockchain has no tip or height index")
+			}
+			tip = append([]byte{}, b.Get([]byte("l"))...)
+
+			return nil
+		})
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Blockchain{tip: tip, DB: readOnlyStorage{db}, progress: os.Stdout}, nil
+}
+
+// checkChainstate repairs the UTXO set when the block it matches is not the
+// tip. A chainstate on another branch is rolled back to the main chain with
+// the undo records of its blocks, and a chainstate on the main chain is
+// brought up to the tip block by block. Any other one is rebuilt, unless the
+// blockchain is pruned.
+func (bc *Blockchain) checkChainstate() error {
+	var best []byte
+
+	err := bc.DB.View(func(tx StorageTx) error {
+		if b := tx.Bucket([]byte(utxoBucket)); b != nil {
+			best = append([]byte{}, b.Get(bestBlockKey)...)
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if bytes.Equal(best, bc.tip) {
+		return nil
+	}
+	fmt.Fprintf(bc.progress, "Chainstate is at block %x but the tip is %x, repairing\n", best, bc.tip)
+
+	UTXOSet := UTXOSet{bc}
+	height := 0
+	err = bc.DB.Update(func(tx StorageTx) error {
+		height, err = UTXOSet.rollBack(tx, best)
+		if err == nil && height+1 < prunedHeight(tx) {
+			err = fmt.Errorf("Blocks it has to apply from height %d on are pruned", height+1)
+		}
+
+		return err
+	})
+	if err == nil {
+		UTXOSet.replay(height + 1)
+
+		return nil
+	}
+
+	reindexErr := UTXOSet.Reindex()
+	if reindexErr != nil {
+		return fmt.Errorf("Chainstate at block %x cannot be repaired: %s. %s", best, err, reindexErr)
+	}
+
+	return nil
+}
+
+// AddBlock saves the block into the blockchain and switches to its branch
+// when that branch has more accumulated work than the current one
+func (bc *Blockchain) AddBlock(block *Block) error {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	heavier := false
+	connected := false
+	var invalid error
+
+	err := bc.DB.Update(func(tx StorageTx) error {
 		b := tx.Bucket([]byte(blocksBucket))
 		blockInDb := b.Get(block.Hash)
 		if blockInDb != nil {
@@ -159,16 +276,295 @@ func (bc *Blockchain) AddBlock(block *Block) {
 			log.Panic(err)
 		}
 
-		lastHash := b.Get([]byte("l"))
-		lastBlockData := b.Get(lastHash)
-		lastBlock := DeserializeBlock(lastBlockData)
+		work := putChainWork(tx, block)
+		heavier = work.Cmp(chainWork(tx, bc.tip)) > 0
+
+		// A block extending the tip is checked against the UTXO set it is
+		// connected to, and stored only along with it
+		if heavier && bytes.Equal(block.PrevBlockHash, bc.tip) {
+			invalid = bc.validateTransactions(tx, block)
+			if invalid != nil {
+				return invalid
+			}
+			bc.connectBlock(tx, block)
+			connected = true
+		}
+
+		return nil
+	})
+	if invalid != nil {
+		return invalid
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if !heavier || connected {
+		return nil
+	}
+
+	return bc.reorganize(block)
+}
+
+// reorganize makes newTip the tip of the blockchain. Blocks of the current
+// branch are disconnected back to the fork point and the blocks of the new
+// branch are validated and connected one by one, all in one transaction, so
+// that the UTXO set always matches the tip even if the node stops midway.
+func (bc *Blockchain) reorganize(newTip *Block) error {
+	if bytes.Equal(newTip.PrevBlockHash, bc.tip) {
+		bc.connectTip(newTip)
+		return nil
+	}
+
+	detach, attach, err := bc.findFork(newTip)
+	if err != nil {
+		return err
+	}
+	if len(detach) > 0 && detach[len(detach)-1].IsPruned() {
+		return errPrunedFork
+	}
+	fmt.Printf("Reorganizing: disconnecting %d blocks, connecting %d blocks\n", len(detach), len(attach))
+
+	UTXOSet := UTXOSet{bc}
+	var undos []BlockUndo
+	for _, block := range detach {
+		undos = append(undos, UTXOSet.blockUndo(block))
+	}
+
+	tip := bc.tip
+	var invalid *Block
+
+	err = bc.DB.Update(func(tx StorageTx) error {
+		for i, block := range detach {
+			bc.disconnectBlock(tx, block, undos[i])
+		}
+
+		for _, block := range attach {
+			err := bc.validateTransactions(tx, block)
+			if err != nil {
+				invalid = block
+				return fmt.Errorf("Block %x of the new branch is invalid: %s", block.Hash, err)
+			}
+			bc.connectBlock(tx, block)
+		}
+
+		return nil
+	})
+	if err != nil {
+		bc.tip = tip
+		if invalid == nil {
+			log.Panic(err)
+		}
+		bc.discardBranch(invalid)
+
+		return err
+	}
+
+	return nil
+}
+
+// findFork returns the blocks to disconnect from the tip down to the fork
+// point and the blocks to connect from the fork point up to newTip
+func (bc *Blockchain) findFork(newTip *Block) ([]*Block, []*Block, error) {
+	var detach, attach []*Block
+
+	oldBlock := bc.mustGetBlock(bc.tip)
+	newBlock := newTip
+
+	parent := func(block *Block) (*Block, error) {
+		prev, err := bc.GetBlock(block.PrevBlockHash)
+		if err != nil {
+			return nil, fmt.Errorf("Parent of block %x cannot be read: %s", block.Hash, err)
+		}
+
+		return &prev, nil
+	}
+
+	var err error
+	for newBlock.Height > oldBlock.Height {
+		attach = append(attach, newBlock)
+		if newBlock, err = parent(newBlock); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for oldBlock.Height > newBlock.Height {
+		detach = append(detach, oldBlock)
+		if oldBlock, err = parent(oldBlock); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for !bytes.Equal(oldBlock.Hash, newBlock.Hash) {
+		detach = append(detach, oldBlock)
+		attach = append(attach, newBlock)
+		if oldBlock, err = parent(oldBlock); err != nil {
+			return nil, nil, err
+		}
+		if newBlock, err = parent(newBlock); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for i, j := 0, len(attach)-1; i < j; i, j = i+1, j-1 {
+		attach[i], attach[j] = attach[j], attach[i]
+	}
+
+	return detach, attach, nil
+}
+
+// CalcPastMedianTime returns the median timestamp of block and the
+// medianTimeBlocks-1 blocks before it
+func (bc *Blockchain) CalcPastMedianTime(block *Block) int64 {
+	var timestamps []int64
+
+	for i := 0; i < medianTimeBlocks; i++ {
+		timestamps = append(timestamps, block.Timestamp)
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+		block = bc.mustGetBlock(block.PrevBlockHash)
+	}
+
+	return medianTime(timestamps)
+}
+
+// connectTip applies a block whose parent is the tip to the UTXO set and
+// makes it the new tip
+func (bc *Blockchain) connectTip(block *Block) {
+	err := bc.DB.Update(func(tx StorageTx) error {
+		bc.connectBlock(tx, block)
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// connectBlock applies a stored block whose parent is the tip to the UTXO set
+// and the indexes and makes it the new tip, all within tx
+func (bc *Blockchain) connectBlock(tx StorageTx, block *Block) {
+	UTXOSet := UTXOSet{bc}
+
+	UTXOSet.connect(tx, block)
+	putHeight(tx, block)
+	indexBlock(tx, block)
+
+	err := tx.Bucket([]byte(blocksBucket)).Put([]byte("l"), block.Hash)
+	if err != nil {
+		log.Panic(err)
+	}
+	bc.tip = block.Hash
+
+	bc.pruneBlocks(tx, block.Height)
+}
+
+// disconnectTip rolls the tip block back out of the UTXO set and makes its
+// parent the new tip
+func (bc *Blockchain) disconnectTip() {
+	UTXOSet := UTXOSet{bc}
+	block := bc.mustGetBlock(bc.tip)
+	undo := UTXOSet.blockUndo(block)
+
+	err := bc.DB.Update(func(tx StorageTx) error {
+		bc.disconnectBlock(tx, block, undo)
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// disconnectBlock rolls the tip block back out of the UTXO set and the
+// indexes and makes its parent the new tip, all within tx
+func (bc *Blockchain) disconnectBlock(tx StorageTx, block *Block, undo BlockUndo) {
+	UTXOSet := UTXOSet{bc}
+
+	UTXOSet.disconnect(tx, block, undo)
+	deleteHeight(tx, block)
+	unindexBlock(tx, block)
 
-		if block.Height > lastBlock.Height {
-			err = b.Put([]byte("l"), block.Hash)
+	err := tx.Bucket([]byte(blocksBucket)).Put([]byte("l"), block.PrevBlockHash)
+	if err != nil {
+		log.Panic(err)
+	}
+	bc.tip = block.PrevBlockHash
+}
+
+// putHeight records a block joining the main chain in the height index
+func putHeight(tx StorageTx, block *Block) {
+	err := tx.Bucket([]byte(heightBucket)).Put(heightKey(block.Height), block.Hash)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// deleteHeight removes a block leaving the main chain from the height index
+func deleteHeight(tx StorageTx, block *Block) {
+	err := tx.Bucket([]byte(heightBucket)).Delete(heightKey(block.Height))
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// heightKey returns the height index key of height, which sorts in height order
+func heightKey(height int) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(height))
+}
+
+// indexBlock adds a block joining the main chain to the optional indexes
+func indexBlock(tx StorageTx, block *Block) {
+	indexTransactions(tx, block)
+	indexAddresses(tx, block)
+}
+
+// unindexBlock removes a block leaving the main chain from the optional indexes
+func unindexBlock(tx StorageTx, block *Block) {
+	unindexTransactions(tx, block)
+	unindexAddresses(tx, block)
+}
+
+// discardBranch removes an invalid block and every stored block built on it
+// so that their branch is never considered again
+func (bc *Blockchain) discardBranch(block *Block) {
+	err := bc.DB.Update(func(tx StorageTx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+
+		// Blocks are only linked to their parent, so the descendants are
+		// found among all the blocks above the invalid one
+		var above []*Block
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if candidate, err := decodeBlock(v); err == nil && candidate.Height > block.Height {
+				above = append(above, candidate)
+			}
+		}
+		sort.Slice(above, func(i, j int) bool { return above[i].Height < above[j].Height })
+
+		discarded := [][]byte{block.Hash}
+		invalid := map[string]bool{string(block.Hash): true}
+		for _, candidate := range above {
+			if invalid[string(candidate.PrevBlockHash)] {
+				discarded = append(discarded, candidate.Hash)
+				invalid[string(candidate.Hash)] = true
+			}
+		}
+
+		w := tx.Bucket([]byte(chainworkBucket))
+		for _, hash := range discarded {
+			err := b.Delete(hash)
 			if err != nil {
 				log.Panic(err)
 			}
-			bc.tip = block.Hash
+
+			if w != nil {
+				err = w.Delete(hash)
+				if err != nil {
+					log.Panic(err)
+				}
+			}
 		}
 
 		return nil
@@ -178,8 +574,71 @@ func (bc *Blockchain) AddBlock(block *Block) {
 	}
 }
 
-// FindTransaction finds a transaction by its ID
+func (bc *Blockchain) mustGetBlock(blockHash []byte) *Block {
+	block, err := bc.GetBlock(blockHash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return &block
+}
+
+// putChainWork stores and returns the total work of the chain ending at block
+func putChainWork(tx StorageTx, block *Block) *big.Int {
+	w, err := tx.CreateBucketIfNotExists([]byte(chainworkBucket))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	work := chainWork(tx, block.PrevBlockHash)
+	work.Add(work, NewProofOfWork(block).Work())
+
+	err = w.Put(block.Hash, work.Bytes())
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return work
+}
+
+// chainWork returns the total work of the chain ending at the given block.
+// Blocks stored before chain work was recorded are summed up one by one.
+func chainWork(tx StorageTx, hash []byte) *big.Int {
+	b := tx.Bucket([]byte(blocksBucket))
+	w := tx.Bucket([]byte(chainworkBucket))
+	total := big.NewInt(0)
+
+	for len(hash) > 0 {
+		if w != nil {
+			if work := w.Get(hash); work != nil {
+				return total.Add(total, new(big.Int).SetBytes(work))
+			}
+		}
+
+		blockData := b.Get(hash)
+		if blockData == nil {
+			break
+		}
+		block := DeserializeBlock(blockData)
+
+		total.Add(total, NewProofOfWork(block).Work())
+		hash = block.PrevBlockHash
+	}
+
+	return total
+}
+
+// FindTransaction finds a transaction of the main chain by its ID, in the
+// transaction index when there is one. Only the outputs of transactions of
+// pruned blocks are known.
 func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
+	if tx, indexed := bc.findIndexedTransaction(ID); indexed {
+		if tx == nil {
+			return Transaction{}, errors.New("Transaction is not found")
+		}
+		return *tx, nil
+	}
+
 	bci := bc.Iterator()
 
 	for {
@@ -196,17 +655,31 @@ func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 		}
 	}
 
+	if tx, found := bc.findPrunedTransaction(ID); found {
+		return *tx, nil
+	}
+
 	return Transaction{}, errors.New("Transaction is not found")
 }
 
-// FindUTXO finds all unspent transaction outputs and returns transactions with spent outputs removed
-func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
-	UTXO := make(map[string]TXOutputs)
+// unspentOutputs walks the main chain back from tip and returns the
+// transactions with unspent outputs, keeping the position of every output. It
+// fails on a block that is missing or cannot be decoded.
+func unspentOutputs(tx StorageTx, tip []byte) (map[string]*SnapshotEntry, error) {
+	UTXO := make(map[string]*SnapshotEntry)
 	spentTXOs := make(map[string][]int)
-	bci := bc.Iterator()
+	b := tx.Bucket([]byte(blocksBucket))
+	hash := tip
 
-	for {
-		block := bci.Next()
+	for len(hash) > 0 {
+		data := b.Get(hash)
+		if data == nil {
+			return nil, fmt.Errorf("Block %x is missing", hash)
+		}
+		block, err := decodeBlock(data)
+		if err != nil {
+			return nil, fmt.Errorf("Block %x cannot be decoded: %s", hash, err)
+		}
 
 		for _, tx := range block.Transactions {
 			txID := hex.EncodeToString(tx.ID)
@@ -222,9 +695,12 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 					}
 				}
 
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[txID] = outs
+				entry := UTXO[txID]
+				if entry == nil {
+					entry = &SnapshotEntry{tx.ID, block.Height, tx.IsCoinbase(), nil}
+					UTXO[txID] = entry
+				}
+				entry.Outputs = append(entry.Outputs, SnapshotOutput{outIdx, out})
 			}
 
 			if !tx.IsCoinbase() {
@@ -235,12 +711,10 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 			}
 		}
 
-		if len(block.PrevBlockHash) == 0 {
-			break
-		}
+		hash = block.PrevBlockHash
 	}
 
-	return UTXO
+	return UTXO, nil
 }
 
 // Iterator returns a BlockchainIterat
@@ -252,13 +726,11 @@ func (bc *Blockchain) Iterator() *BlockchainIterator {
 
 // GetBestHeight returns the height of the latest block
 func (bc *Blockchain) GetBestHeight() int {
-	var lastBlock Block
+	var height int
 
-	err := bc.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		lastHash := b.Get([]byte("l"))
-		blockData := b.Get(lastHash)
-		lastBlock = *DeserializeBlock(blockData)
+	err := bc.DB.View(func(tx StorageTx) error {
+		k, _ := tx.Bucket([]byte(heightBucket)).Cursor().Last()
+		height = int(binary.BigEndian.Uint64(k))
 
 		return nil
 	})
@@ -266,14 +738,41 @@ func (bc *Blockchain) GetBestHeight() int {
 		log.Panic(err)
 	}
 
-	return lastBlock.Height
+	return height
+}
+
+// GetBlockHash returns the hash of the main chain block at height
+func (bc *Blockchain) GetBlockHash(height int) ([]byte, error) {
+	var hash []byte
+
+	err := bc.DB.View(func(tx StorageTx) error {
+		h := tx.Bucket([]byte(heightBucket)).Get(heightKey(height))
+		if height < 0 || h == nil {
+			return errors.New("Block is not found")
+		}
+		hash = append([]byte{}, h...)
+
+		return nil
+	})
+
+	return hash, err
+}
+
+// GetBlockByHeight finds the main chain block at height and returns it
+func (bc *Blockchain) GetBlockByHeight(height int) (Block, error) {
+	hash, err := bc.GetBlockHash(height)
+	if err != nil {
+		return Block{}, err
+	}
+
+	return bc.GetBlock(hash)
 }
 
 // GetBlock finds a block by its hash and returns it
 func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
 
-	err := bc.DB.View(func(tx *bolt.Tx) error {
+	err := bc.DB.View(func(tx StorageTx) error {
 		b := tx.Bucket([]byte(blocksBucket))
 
 		blockData := b.Get(blockHash)
@@ -282,7 +781,11 @@ func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 			return errors.New("Block is not found")
 		}
 
-		block = *DeserializeBlock(blockData)
+		decoded, err := decodeBlock(blockData)
+		if err != nil {
+			return fmt.Errorf("Block %x cannot be decoded: %s", blockHash, err)
+		}
+		block = *decoded
 
 		return nil
 	})
@@ -293,69 +796,72 @@ func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	return block, nil
 }
 
-// GetBlockHashes returns a list of hashes of all the blocks in the chain
-func (bc *Blockchain) GetBlockHashes(height int) [][]byte {
+// GetBlockHashes returns the hashes of at most limit main chain blocks above
+// height, the earliest first
+func (bc *Blockchain) GetBlockHashes(height, limit int) [][]byte {
 	var blocks [][]byte
-	bci := bc.Iterator()
 
-	for {
-		block := bci.Next()
-		if block.Height > height {
-			blocks = append(blocks, block.Hash)
-		} else {
-			break
-		}
+	err := bc.DB.View(func(tx StorageTx) error {
+		c := tx.Bucket([]byte(heightBucket)).Cursor()
 
-		if len(block.PrevBlockHash) == 0 {
-			break
+		for k, v := c.Seek(heightKey(height + 1)); k != nil && len(blocks) < limit; k, v = c.Next() {
+			blocks = append(blocks, append([]byte{}, v...))
 		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
 	}
 
 	return blocks
 }
 
-// MineBlock mines a new block with the provided transactions
-func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
-	var lastHash []byte
-	var lastHeight int
+// MineBlock mines a new block with the provided transactions and applies it
+// to the UTXO set. The transactions are checked as those of a block received
+// from a peer before any work is spent on them.
+func (bc *Blockchain) MineBlock(transactions []*Transaction) (*Block, error) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	var lastBlock *Block
 
 	for _, tx := range transactions {
-		// TODO: ignore transaction if it's not valid
-		if !bc.VerifyTransaction(tx) {
-			log.Panic("ERROR: Invalid transaction")
+		err := checkTransaction(tx)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	err := bc.DB.View(func(tx *bolt.Tx) error {
+	err := bc.DB.View(func(tx StorageTx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("l"))
+		lastHash := b.Get([]byte("l"))
 
 		blockData := b.Get(lastHash)
-		block := DeserializeBlock(blockData)
+		lastBlock = DeserializeBlock(blockData)
 
-		lastHeight = block.Height
-
-		return nil
+		return bc.validateTransactions(tx, &Block{Transactions: transactions, Height: lastBlock.Height + 1})
 	})
 	if err != nil {
-		log.Panic(err)
+		return nil, err
+	}
+
+	timestamp := adjustedTime()
+	if medianTime := bc.CalcPastMedianTime(lastBlock); timestamp <= medianTime {
+		timestamp = medianTime + 1
 	}
 
-	newBlock := NewBlock(transactions, lastHash, lastHeight+1)
+	newBlock := NewBlock(transactions, lastBlock.Hash, lastBlock.Height+1, bc.CalcNextBits(lastBlock), timestamp)
 
-	err = bc.DB.Update(func(tx *bolt.Tx) error {
+	err = bc.DB.Update(func(tx StorageTx) error {
 		b := tx.Bucket([]byte(blocksBucket))
 		err := b.Put(newBlock.Hash, newBlock.Serialize())
 		if err != nil {
 			log.Panic(err)
 		}
 
-		err = b.Put([]byte("l"), newBlock.Hash)
-		if err != nil {
-			log.Panic(err)
-		}
-
-		bc.tip = newBlock.Hash
+		putChainWork(tx, newBlock)
+		bc.connectBlock(tx, newBlock)
 
 		return nil
 	})
@@ -363,7 +869,68 @@ func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
 		log.Panic(err)
 	}
 
-	return newBlock
+	return newBlock, nil
+}
+
+// SelectTransactions picks the transactions for a new block, highest fee rate
+// first, while the block stays within maxBlockSize and maxBlockSigOps. Invalid
+// transactions and those spending an output a picked one spends are dropped,
+// the others left out are meant to wait for a later block.
+func (bc *Blockchain) SelectTransactions(candidates []*Transaction) []*Transaction {
+	type candidate struct {
+		tx   *Transaction
+		fee  int
+		size int
+	}
+
+	var sorted []candidate
+	for _, tx := range candidates {
+		err := bc.validateTransaction(tx)
+		if err != nil {
+			fmt.Printf("Dropping transaction %x: %s\n", tx.ID, err)
+			continue
+		}
+		fee, err := bc.CalculateFee(tx)
+		if err != nil {
+			fmt.Printf("Dropping transaction %x: %s\n", tx.ID, err)
+			continue
+		}
+		sorted = append(sorted, candidate{tx, fee, len(tx.Serialize())})
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].fee*sorted[j].size > sorted[j].fee*sorted[i].size
+	})
+
+	var selected []*Transaction
+	size := blockReservedSize
+	sigOps := 0
+	spent := make(map[string]bool)
+
+	for _, c := range sorted {
+		txSigOps := countSigOps(c.tx)
+		if size+c.size > maxBlockSize || sigOps+txSigOps > maxBlockSigOps {
+			continue
+		}
+
+		conflicts := false
+		for _, vin := range c.tx.Vin {
+			conflicts = conflicts || spent[string(outpointKey(vin.Txid, vin.Vout))]
+		}
+		if conflicts {
+			fmt.Printf("Dropping transaction %x: it spends an output of another one\n", c.tx.ID)
+			continue
+		}
+		for _, vin := range c.tx.Vin {
+			spent[string(outpointKey(vin.Txid, vin.Vout))] = true
+		}
+
+		selected = append(selected, c.tx)
+		size += c.size
+		sigOps += txSigOps
+	}
+
+	return selected
 }
 
 // SignTransaction signs inputs of a Transaction
@@ -381,6 +948,39 @@ func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey)
 	tx.Sign(privKey, prevTXs)
 }
 
+// CalculateFee returns the fee paid by a transaction: the value of its inputs
+// that is not spent on its outputs. Transactions whose outputs cannot be
+// trusted or that spend more than their inputs have no fee.
+func (bc *Blockchain) CalculateFee(tx *Transaction) (int, error) {
+	err := checkOutputs(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+
+	inputs := 0
+	for _, vin := range tx.Vin {
+		prevTX, err := bc.FindTransaction(vin.Txid)
+		if err != nil {
+			return 0, err
+		}
+		if vin.Vout < 0 || vin.Vout >= len(prevTX.Vout) {
+			return 0, fmt.Errorf("Transaction %x spends missing output %x:%d", tx.ID, vin.Txid, vin.Vout)
+		}
+		inputs += prevTX.Vout[vin.Vout].Value
+	}
+
+	outputs := outputsValue(tx)
+	if outputs > inputs {
+		return 0, fmt.Errorf("Transaction %x spends %d but only has %d", tx.ID, outputs, inputs)
+	}
+
+	return inputs - outputs, nil
+}
+
 // VerifyTransaction verifies transaction input signatures
 func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
 	if tx.IsCoinbase() {
@@ -400,25 +1000,17 @@ func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
 	return tx.Verify(prevTXs)
 }
 
-func dbExists(dbFile string) bool {
-	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
-		return false
-	}
-
-	return true
-}
-
 // BlockchainIterator is used to iterate over blockchain blocks
 type BlockchainIterator struct {
 	currentHash []byte
-	db          *bolt.DB
+	db          Storage
 }
 
 // Next returns next block starting from the tip
 func (i *BlockchainIterator) Next() *Block {
 	var block *Block
 
-	err := i.db.View(func(tx *bolt.Tx) error {
+	err := i.db.View(func(tx StorageTx) error {
 		b := tx.Bucket([]byte(blocksBucket))
 		encBlock := b.Get(i.currentHash)
 		block = DeserializeBlock(encBlock)
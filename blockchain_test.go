@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReorganize(t *testing.T) {
+	type branch struct {
+		fork    int  // height of the main chain block the branch starts on
+		length  int  // number of blocks
+		spend   bool // spend the genesis allocation in the first block
+		invalid bool // the last block claims too much in its coinbase
+	}
+
+	tests := []struct {
+		name     string
+		branches []branch
+		tip      int // branch the tip ends on
+		balance  int // of the genesis allocation
+	}{
+		{"longer branch replaces the tip", []branch{{0, 1, true, false}, {0, 2, false, false}}, 1, 10},
+		{"equal work keeps the first branch", []branch{{0, 2, true, false}, {0, 2, false, false}}, 0, 3},
+		{"branch off the middle of the chain", []branch{{0, 4, true, false}, {2, 3, false, false}}, 1, 3},
+		{"back to an earlier fork", []branch{{0, 1, true, false}, {0, 2, false, false}, {0, 3, true, false}}, 2, 3},
+		{"invalid branch is rolled back", []branch{{0, 2, true, false}, {0, 3, false, true}}, 0, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "reorg")
+			_, miner := newTestWallet()
+			_, payee := newTestWallet()
+			spend := c.send(testWallet, payee, 7, 0)
+
+			var tips []*Block
+			for _, br := range tt.branches {
+				parent, err := c.bc.GetBlockByHeight(br.fork)
+				if err != nil {
+					t.Fatal(err)
+				}
+				block := &parent
+
+				for i := 0; i < br.length; i++ {
+					var txs []*Transaction
+					if i == 0 && br.spend {
+						txs = append(txs, spend)
+					}
+					block = c.newBlock(block, miner, txs...)
+
+					if br.invalid && i == br.length-1 {
+						c.time++
+						block = NewBlock([]*Transaction{NewCoinbaseTX(miner, "", 1000)}, block.PrevBlockHash, block.Height, block.Bits, c.time)
+					}
+					err := c.bc.ValidateBlock(block)
+					if err == nil {
+						err = c.bc.AddBlock(block)
+					}
+					if (err != nil) != (br.invalid && i == br.length-1) {
+						t.Fatalf("Block %d of the branch: %v", i, err)
+					}
+				}
+				tips = append(tips, block)
+			}
+
+			want := tips[tt.tip]
+			if !bytes.Equal(c.bc.tip, want.Hash) {
+				t.Fatalf("Tip is at height %d, want the tip of branch %d", c.tip().Height, tt.tip)
+			}
+			for block := want; len(block.PrevBlockHash) > 0; block = c.bc.mustGetBlock(block.PrevBlockHash) {
+				if hash, _ := c.bc.GetBlockHash(block.Height); !bytes.Equal(hash, block.Hash) {
+					t.Fatalf("Height index has another block at height %d", block.Height)
+				}
+			}
+			if _, err := c.bc.GetBlockHash(want.Height + 1); err == nil {
+				t.Fatal("Height index has blocks above the tip")
+			}
+			if got := c.balance(string(testWallet.GetAddress())); got != tt.balance {
+				t.Errorf("Balance is %d, want %d", got, tt.balance)
+			}
+			if _, err := c.bc.VerifyChain(0, verifyUTXO); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestSelectTransactions(t *testing.T) {
+	type candidate struct {
+		fee      int
+		padding  int  // bytes added to the transaction
+		from     int  // wallet whose output it spends
+		negative bool // it has a negative output
+	}
+
+	tests := []struct {
+		name       string
+		candidates []candidate
+		selected   []int
+	}{
+		{"highest fee rate first", []candidate{{1, 0, 0, false}, {3, 0, 1, false}, {2, 0, 2, false}}, []int{1, 2, 0}},
+		{"fee rate rather than fee", []candidate{{3, 400000, 0, false}, {1, 0, 1, false}}, []int{1, 0}},
+		{"equal rates keep their order", []candidate{{2, 0, 0, false}, {2, 0, 1, false}}, []int{0, 1}},
+		{"left out when the block is full", []candidate{{1, 600000, 0, false}, {3, 600000, 1, false}}, []int{1}},
+		{"smaller ones still fill the block", []candidate{{3, 600000, 0, false}, {2, 600000, 1, false}, {1, 0, 2, false}}, []int{2, 0}},
+		{"spends of the same output keep the highest fee rate", []candidate{{1, 0, 0, false}, {3, 0, 0, false}, {2, 0, 1, false}}, []int{1, 2}},
+		{"negative output dropped", []candidate{{1, 0, 0, true}, {1, 0, 1, false}}, []int{1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "select")
+			_, xAddress := newTestWallet()
+			_, miner := newTestWallet()
+
+			// Candidates spend the output their wallet is paid, which covers
+			// the highest fee paid from it
+			funds := make([]int, len(tt.candidates))
+			for _, cand := range tt.candidates {
+				funds[cand.from] = max(funds[cand.from], cand.fee+1)
+			}
+			var wallets []*Wallet
+			for _, amount := range funds {
+				if amount > 0 {
+					wallet, address := newTestWallet()
+					c.mine(miner, c.send(testWallet, address, amount, 0))
+					wallets = append(wallets, wallet)
+				}
+			}
+
+			var candidates []*Transaction
+			for _, cand := range tt.candidates {
+				wallet := wallets[cand.from]
+				tx := c.send(wallet, xAddress, 1, cand.fee)
+				tx.Vout[0].PubKeyHash = append(tx.Vout[0].PubKeyHash, make([]byte, cand.padding)...)
+				if cand.negative {
+					tx.Vout[0].Value = -1
+				}
+				resign(c, tx, wallet)
+				candidates = append(candidates, tx)
+			}
+
+			selected := c.bc.SelectTransactions(candidates)
+			if len(selected) != len(tt.selected) {
+				t.Fatalf("%d transactions selected, want %d", len(selected), len(tt.selected))
+			}
+			for i, want := range tt.selected {
+				if selected[i] != candidates[want] {
+					t.Errorf("Transaction %d is not candidate %d", i, want)
+				}
+			}
+		})
+	}
+}
+
+// resign gives a changed transaction its ID and signatures again
+func resign(c *testChain, tx *Transaction, wallet *Wallet) {
+	for i := range tx.Vin {
+		tx.Vin[i].Signature = nil
+	}
+	tx.ID = tx.Hash()
+	c.bc.SignTransaction(tx, wallet.PrivateKey)
+}
+
+// Mining checks the transactions as a peer receiving the block would
+func TestMineBlock(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *testChain, txs []*Transaction) []*Transaction
+		err    string
+	}{
+		{"valid transactions", func(c *testChain, txs []*Transaction) []*Transaction { return txs }, ""},
+		{"same output spent twice", func(c *testChain, txs []*Transaction) []*Transaction {
+			_, address := newTestWallet()
+			return append(txs, c.send(testWallet, address, 2, 0))
+		}, "twice"},
+		{"negative output", func(c *testChain, txs []*Transaction) []*Transaction {
+			txs[1].Vout[0].Value = -1
+			resign(c, txs[1], testWallet)
+			return txs
+		}, "negative output"},
+		{"coinbase claiming too much", func(c *testChain, txs []*Transaction) []*Transaction {
+			txs[0] = NewCoinbaseTX(string(testWallet.GetAddress()), "", 1000)
+			return txs
+		}, "Coinbase claims"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "mine")
+			_, miner := newTestWallet()
+			_, payee := newTestWallet()
+
+			coinbase := NewCoinbaseTX(miner, "", GetBlockSubsidy(1))
+			txs := tt.change(c, []*Transaction{coinbase, c.send(testWallet, payee, 3, 0)})
+
+			block, err := c.bc.MineBlock(txs)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Mine: %v, want %q", err, tt.err)
+				}
+				if c.bc.GetBestHeight() != 0 {
+					t.Error("Block is added")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(c.bc.tip, block.Hash) || c.balance(payee) != 3 {
+				t.Error("Block is not connected")
+			}
+		})
+	}
+}
+
+// A reorganization that fails leaves no part of either branch applied
+func TestReorganizeIsAtomic(t *testing.T) {
+	tests := []struct {
+		name    string
+		length  int // of the new branch
+		invalid int // index of its invalid block
+	}{
+		{"first block invalid", 3, 0},
+		{"middle block invalid", 3, 1},
+		{"last block invalid", 3, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "atomic")
+			_, miner := newTestWallet()
+			_, payee := newTestWallet()
+			spend := c.send(testWallet, payee, 7, 0)
+			c.mine(miner, spend)
+			c.mine(miner)
+			tip := c.tip()
+			_, hash := c.bc.UTXOSnapshot()
+
+			// The branch spends the same output and only outweighs the tip
+			// with its last block
+			block := GetGenesisBlock()
+			var branch []*Block
+			for i := 0; i < tt.length; i++ {
+				var txs []*Transaction
+				if i == 0 {
+					txs = append(txs, spend)
+				}
+				block = c.newBlock(block, miner, txs...)
+				if i == tt.invalid {
+					block = NewBlock([]*Transaction{NewCoinbaseTX(miner, "", 1000)}, block.PrevBlockHash, block.Height, block.Bits, c.time)
+				}
+
+				err := c.bc.ValidateBlock(block)
+				if err == nil {
+					err = c.bc.AddBlock(block)
+				}
+				if i == tt.length-1 && err == nil {
+					t.Fatal("Invalid branch accepted")
+				}
+				branch = append(branch, block)
+			}
+
+			// The invalid block goes with the blocks built on it, and a block
+			// extending them waits for its parent
+			for i, block := range branch {
+				if _, err := c.bc.GetBlock(block.Hash); (err == nil) != (i < tt.invalid) {
+					t.Errorf("Block %d of the branch kept: %v", i, err == nil)
+				}
+			}
+			if err := c.bc.ValidateBlock(c.newBlock(block, miner)); err != errOrphanBlock {
+				t.Errorf("Block on the discarded branch: %v", err)
+			}
+
+			c.reopen()
+			if !bytes.Equal(c.bc.tip, tip.Hash) {
+				t.Fatalf("Tip moved to height %d", c.tip().Height)
+			}
+			if _, got := c.bc.UTXOSnapshot(); !bytes.Equal(got, hash) {
+				t.Fatal("UTXO set changed")
+			}
+			if _, err := c.bc.VerifyChain(0, verifyUTXO); err != nil {
+				t.Fatal(err)
+			}
+			c.mine(miner)
+		})
+	}
+}
+
+// A block checked while its parent was not the tip yet has its transactions
+// checked when it is connected
+func TestAddBlockValidatesTransactions(t *testing.T) {
+	c := newTestChain(t, "connect")
+	_, miner := newTestWallet()
+	parent := c.newBlock(c.tip(), miner)
+	c.add(parent)
+	c.bc.disconnectTip()
+
+	c.time++
+	block := NewBlock([]*Transaction{NewCoinbaseTX(miner, "", 1000)}, parent.Hash, parent.Height+1, parent.Bits, c.time)
+	if err := c.bc.ValidateBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	c.bc.connectTip(parent)
+
+	if err := c.bc.AddBlock(block); err == nil || !strings.Contains(err.Error(), "Coinbase claims") {
+		t.Fatalf("Add: %v", err)
+	}
+	if !bytes.Equal(c.bc.tip, parent.Hash) {
+		t.Fatal("Tip moved")
+	}
+	if _, err := c.bc.GetBlock(block.Hash); err == nil {
+		t.Error("Invalid block is stored")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// A chain file holds a range of main chain blocks. It starts with
+// chainFileMagic and is followed by records, each a 4-byte big-endian length
+// and that many bytes: the first record is a ChainFileHeader describing the
+// file, every other one a serialized block, in height order.
+var chainFileMagic = []byte("BLKF")
+
+const chainFileVersion = 1
+
+// A record of a chain or UTXO snapshot file is never bigger than the largest
+// valid block
+const maxRecordSize = maxBlockSize
+
+// importProgressInterval is how many blocks are imported between progress lines
+const importProgressInterval = 100
+
+// ChainFileHeader tells which network and which heights a chain file is for
+type ChainFileHeader struct {
+	Version     int
+	Network     string
+	Magic       [4]byte
+	GenesisHash []byte
+	From        int
+	To          int
+}
+
+// Serialize serializes ChainFileHeader
+func (header ChainFileHeader) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(header)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// DeserializeChainFileHeader deserializes ChainFileHeader
+func DeserializeChainFileHeader(data []byte) (ChainFileHeader, error) {
+	var header ChainFileHeader
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&header)
+
+	return header, err
+}
+
+// ExportBlocks writes the main chain blocks from height from to height to,
+// both included, as a chain file
+func (bc *Blockchain) ExportBlocks(w io.Writer, from, to int) error {
+	if from < 0 || to < from || to > bc.GetBestHeight() {
+		return fmt.Errorf("Heights %d to %d are not on the main chain", from, to)
+	}
+	if prunedHeight := bc.PrunedHeight(); from < prunedHeight {
+		return fmt.Errorf("Blocks below height %d are pruned", prunedHeight)
+	}
+
+	buffered := bufio.NewWriter(w)
+	_, err := buffered.Write(chainFileMagic)
+	if err != nil {
+		return err
+	}
+
+	header := ChainFileHeader{chainFileVersion, activeNetParams.Name, activeNetParams.Magic, GetGenesisBlock().Hash, from, to}
+	err = writeRecord(buffered, header.Serialize())
+	if err != nil {
+		return err
+	}
+
+	for height := from; height <= to; height++ {
+		block, err := bc.GetBlockByHeight(height)
+		if err != nil {
+			return err
+		}
+
+		err = writeRecord(buffered, block.Serialize())
+		if err != nil {
+			return err
+		}
+	}
+
+	return buffered.Flush()
+}
+
+// ImportBlocks reads a chain file and adds its blocks to the blockchain,
+// validating each of them like a block received from a peer. It returns how
+// many blocks were added and how many were already known.
+func (bc *Blockchain) ImportBlocks(r io.Reader) (imported, known int, err error) {
+	buffered := bufio.NewReader(r)
+
+	magic := make([]byte, len(chainFileMagic))
+	_, err = io.ReadFull(buffered, magic)
+	if err != nil || !bytes.Equal(magic, chainFileMagic) {
+		return 0, 0, errors.New("Not a chain file")
+	}
+
+	headerData, err := readRecord(buffered)
+	if err != nil {
+		return 0, 0, err
+	}
+	header, err := DeserializeChainFileHeader(headerData)
+	if err != nil {
+		return 0, 0, err
+	}
+	if header.Version != chainFileVersion {
+		return 0, 0, fmt.Errorf("Chain file version %d is not supported", header.Version)
+	}
+	if header.Magic != activeNetParams.Magic || !bytes.Equal(header.GenesisHash, GetGenesisBlock().Hash) {
+		return 0, 0, fmt.Errorf("Chain file is for network %s, not %s", header.Network, activeNetParams.Name)
+	}
+
+	total := header.To - header.From + 1
+	fmt.Printf("Importing %d blocks, heights %d to %d\n", total, header.From, header.To)
+
+	for {
+		blockData, err := readRecord(buffered)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, known, err
+		}
+		block, err := decodeBlock(blockData)
+		if err != nil {
+			return imported, known, fmt.Errorf("Block %d of the chain file cannot be decoded: %s", imported+known+1, err)
+		}
+		if block.Height < header.From || block.Height > header.To {
+			return imported, known, fmt.Errorf("Block %x at height %d is outside heights %d to %d of the chain file", block.Hash, block.Height, header.From, header.To)
+		}
+
+		if _, err := bc.GetBlock(block.Hash); err == nil {
+			known++
+			continue
+		}
+
+		err = bc.ValidateBlock(block)
+		if err == nil {
+			err = bc.AddBlock(block)
+		}
+		if err != nil {
+			return imported, known, fmt.Errorf("Block %x at height %d is rejected: %s", block.Hash, block.Height, err)
+		}
+
+		imported++
+		if imported%importProgressInterval == 0 {
+			fmt.Printf("Imported %d of %d blocks, at height %d\n", imported+known, total, block.Height)
+		}
+	}
+
+	return imported, known, nil
+}
+
+func writeRecord(w io.Writer, data []byte) error {
+	err := binary.Write(w, binary.BigEndian, uint32(len(data)))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// readRecord returns io.EOF at the end of the file and an error for a file
+// ending in the middle of a record
+func readRecord(r io.Reader) ([]byte, error) {
+	var length uint32
+
+	err := binary.Read(r, binary.BigEndian, &length)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, errors.New("File is truncated")
+	}
+	if length > maxRecordSize {
+		return nil, fmt.Errorf("Record of %d bytes is too big", length)
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, errors.New("File is truncated")
+	}
+
+	return data, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to int
+		known    int // blocks the importing node has above the genesis block
+		change   func(file []byte) []byte
+		imported int
+		err      string
+	}{
+		{"whole chain", 0, 6, 0, nil, 6, ""},
+		{"range of blocks", 1, 3, 0, nil, 3, ""},
+		{"blocks already known", 0, 6, 4, nil, 2, ""},
+		{"range not following the tip", 4, 6, 0, nil, 0, "rejected"},
+		{"truncated file", 0, 6, 0, func(file []byte) []byte { return file[:len(file)-10] }, 5, "truncated"},
+		{"not a chain file", 0, 6, 0, func(file []byte) []byte { return append([]byte("XXXX"), file[4:]...) }, 0, "Not a chain file"},
+		{"malformed block", 1, 3, 0, func(file []byte) []byte {
+			// Garble the gob of the last block, keeping its record length
+			for i := len(file) - 40; i < len(file); i++ {
+				file[i] = 0xff
+			}
+			return file
+		}, 2, "cannot be decoded"},
+		{"block outside the range of the file", 1, 3, 0, func(file []byte) []byte {
+			header := ChainFileHeader{chainFileVersion, activeNetParams.Name, activeNetParams.Magic, GetGenesisBlock().Hash, 1, 2}
+			return replaceHeader(file, header)
+		}, 2, "outside heights 1 to 2"},
+		{"other network", 0, 6, 0, func(file []byte) []byte {
+			header := ChainFileHeader{chainFileVersion, "other", [4]byte{1, 2, 3, 4}, GetGenesisBlock().Hash, 0, 6}
+			return replaceHeader(file, header)
+		}, 0, "network other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "export")
+			_, miner := newTestWallet()
+			_, payee := newTestWallet()
+			c.mine(miner, c.send(testWallet, payee, 7, 1))
+			c.mineBlocks(5, miner)
+
+			var buff bytes.Buffer
+			if err := c.bc.ExportBlocks(&buff, tt.from, tt.to); err != nil {
+				t.Fatal(err)
+			}
+			file := buff.Bytes()
+			if tt.change != nil {
+				file = tt.change(file)
+			}
+
+			to := newTestChain(t, "import")
+			for height := 1; height <= tt.known; height++ {
+				block, _ := c.bc.GetBlockByHeight(height)
+				to.add(&block)
+			}
+
+			imported, _, err := to.bc.ImportBlocks(bytes.NewReader(file))
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("Import: %v, want %q", err, tt.err)
+			}
+			if imported != tt.imported {
+				t.Errorf("Imported %d blocks, want %d", imported, tt.imported)
+			}
+			if tt.err == "" && !bytes.Equal(to.bc.tip, hashAt(t, c, tt.to)) {
+				t.Errorf("Tip is at height %d, want %d", to.tip().Height, tt.to)
+			}
+		})
+	}
+}
+
+// replaceHeader returns the chain file with another header record
+func replaceHeader(file []byte, header ChainFileHeader) []byte {
+	r := bytes.NewReader(file[len(chainFileMagic):])
+	readRecord(r)
+
+	var buff bytes.Buffer
+	buff.Write(chainFileMagic)
+	writeRecord(&buff, header.Serialize())
+	buff.Write(file[len(file)-r.Len():])
+
+	return buff.Bytes()
+}
+
+func hashAt(t *testing.T, c *testChain, height int) []byte {
+	t.Helper()
+
+	hash, err := c.bc.GetBlockHash(height)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hash
+}
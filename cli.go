@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"strconv"
 	"strings"
@@ -15,6 +19,40 @@ type CLI struct{}
 
 const indent = "  "
 
+// stringList collects the values of a flag that is given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseWithArguments parses the flags of cmd, which may come before or after
+// its other arguments, and returns those arguments
+func parseWithArguments(cmd *flag.FlagSet, args []string) []string {
+	var arguments []string
+
+	for {
+		err := cmd.Parse(args)
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		if err != nil {
+			os.Exit(1)
+		}
+		if cmd.NArg() == 0 {
+			return arguments
+		}
+
+		arguments = append(arguments, cmd.Arg(0))
+		args = cmd.Args()[1:]
+	}
+}
+
 func (cli *CLI) createPrompt(cmd string, args []string, explains []string) string {
 	var sb strings.Builder
 
@@ -33,17 +71,49 @@ func (cli *CLI) printUsage() {
 	fmt.Println(cli.createPrompt("wallet",
 		[]string{"-c",
 			"-l",
-			"-T -f A -t B -a AMOUNT [-m]"},
+			"-T -f A -t B -a AMOUNT [-fee FEE | -feerate RATE] [-m]"},
 		[]string{"Create a new account in wallet",
 			"List all accounts in wallet",
-			"Transfer AMOUNT money from A to B, mine coin if -m flag is set"}))
+			"Transfer AMOUNT money from A to B paying FEE, or RATE per 1000 bytes, to the miner, mine coin if -m flag is set"}))
 	fmt.Println(cli.createPrompt("service",
-		[]string{"-s [-m ADDRESS]",
-			"-p",
-			"-b ADDRESS"},
-		[]string{"Start service, mine coin if ADDRESS is given",
-			"Print all blocks in the blockchain",
-			"Get balance of ADDRESS"}))
+		[]string{"-s [-m ADDRESS] [-prune N]",
+			"-p [-from HEIGHT] [-to HEIGHT]",
+			"-b ADDRESS",
+			"-history ADDRESS [-offset N] [-limit N]",
+			"-txindex",
+			"-addrindex",
+			"-reindex",
+			"-utxostats"},
+		[]string{"Start service, mine coin if ADDRESS is given, keep the transactions of the latest N blocks only if N is given",
+			"Print the blocks from height -to (default the latest) down to height -from (default 0)",
+			"Get balance of ADDRESS",
+			"List the transactions of ADDRESS, newest first, skipping N and showing at most N (default 10)",
+			"Build, or rebuild, the transaction index and keep it up to date from then on",
+			"Build, or rebuild, the address index that -history needs and keep it up to date from then on",
+			"Rebuild the UTXO set from the blocks, carrying on from where it stopped the next time if interrupted",
+			"Show the size, supply and hash of the UTXO set, which nodes at the same block can compare"}))
+	fmt.Println(cli.createPrompt("genesis",
+		[]string{"create -alloc ADDRESS:AMOUNT [-alloc ADDRESS:AMOUNT ...] -message TEXT [-name NAME]"},
+		[]string{"Mine a genesis block paying every allocation and write it to NAME.blk, along with the parameters of network NAME to NAME.json"}))
+	fmt.Println(cli.createPrompt("chain",
+		[]string{"export [-from HEIGHT] [-to HEIGHT] [FILE]",
+			"import FILE",
+			"verify [-depth N] [-level L]"},
+		[]string{"Write the main chain blocks from height -from (default 0) to height -to (default the latest) to FILE, or to the standard output if FILE is - or missing",
+			"Validate and add the blocks of a file written by chain export, read from the standard input if FILE is -",
+			"Check the latest N blocks (default all) at level L: 0 headers, 1 blocks, 2 transactions, 3 (default) also the UTXO set. Exits 0 if consistent, 1 if it cannot check, 2 plus the level of the first failed check otherwise"}))
+	fmt.Println(cli.createPrompt("utxo",
+		[]string{"dump [FILE]",
+			"load FILE"},
+		[]string{"Write the UTXO set of the latest block to FILE, or to the standard output if FILE is - or missing",
+			"Start a new node from a UTXO snapshot the network trusts, read from the standard input if FILE is -"}))
+	fmt.Println(cli.createPrompt("every command",
+		[]string{"-network NAME",
+			"-params FILE",
+			"-storage KIND"},
+		[]string{"Run on network NAME: mainnet (default), testnet or regtest",
+			"Run on the network described in FILE, as written by genesis create",
+			"Keep the blockchain in KIND of storage: bolt (default) or memory, which is lost when the node stops"}))
 }
 
 func (cli *CLI) validateArgs() {
@@ -57,15 +127,23 @@ func (cli *CLI) validateArgs() {
 func (cli *CLI) Run() {
 	cli.validateArgs()
 
-	nodeID := os.Getenv("NODE_ID")
-	if nodeID == "" {
-		fmt.Printf("NODE_ID env. var is not set!")
-		os.Exit(1)
-	}
-	CreateGenesisIfNeeded(nodeID)
-
 	walletCmd := flag.NewFlagSet("wallet", flag.ExitOnError)
 	serviceCmd := flag.NewFlagSet("service", flag.ExitOnError)
+	genesisCreateCmd := flag.NewFlagSet("genesis create", flag.ExitOnError)
+	chainExportCmd := flag.NewFlagSet("chain export", flag.ExitOnError)
+	chainImportCmd := flag.NewFlagSet("chain import", flag.ExitOnError)
+	// chain verify exits with 2 and up for the inconsistencies it finds, so
+	// its flag errors exit with 1 rather than the 2 of flag.ExitOnError
+	chainVerifyCmd := flag.NewFlagSet("chain verify", flag.ContinueOnError)
+	utxoDumpCmd := flag.NewFlagSet("utxo dump", flag.ExitOnError)
+	utxoLoadCmd := flag.NewFlagSet("utxo load", flag.ExitOnError)
+
+	var network, paramsFile, storage string
+	for _, cmd := range []*flag.FlagSet{walletCmd, serviceCmd, genesisCreateCmd, chainExportCmd, chainImportCmd, chainVerifyCmd, utxoDumpCmd, utxoLoadCmd} {
+		cmd.StringVar(&network, "network", mainNetParams.Name, "Network to use: mainnet, testnet or regtest")
+		cmd.StringVar(&paramsFile, "params", "", "Chain-params file of the network to use")
+		cmd.StringVar(&storage, "storage", boltBackend.Name, "Storage to keep the blockchain in: bolt or memory")
+	}
 
 	createWalletFlag := walletCmd.Bool("c", false, "Create a new account in wallet")
 	listWalletFlag := walletCmd.Bool("l", false, "List all accounts in wallet")
@@ -73,13 +151,34 @@ func (cli *CLI) Run() {
 
 	startFlag := serviceCmd.Bool("s", false, "Start Servece, mine coin if ADDRESS is given")
 	printFlag := serviceCmd.Bool("p", false, "Print all blocks in the blockchain")
+	printFrom := serviceCmd.Int("from", 0, "Lowest height to print")
+	printTo := serviceCmd.Int("to", -1, "Highest height to print, the latest block by default")
+	txIndexFlag := serviceCmd.Bool("txindex", false, "Build, or rebuild, the transaction index")
+	addrIndexFlag := serviceCmd.Bool("addrindex", false, "Build, or rebuild, the address index")
+	reindexFlag := serviceCmd.Bool("reindex", false, "Rebuild the UTXO set")
+	utxoStatsFlag := serviceCmd.Bool("utxostats", false, "Show statistics of the UTXO set")
 
 	fromAddr := walletCmd.String("f", "", "Source wallet address")
 	toAddr := walletCmd.String("t", "", "Destination wallet address")
 	transferAmount := walletCmd.Int("a", 0, "Amount to trainsfer")
 	transferMine := walletCmd.Bool("m", false, "Mine immediately on the same node")
+	transferFee := walletCmd.Int("fee", 0, "Fee to pay to the miner")
+	transferFeeRate := walletCmd.Int("feerate", 0, "Fee to pay to the miner per 1000 bytes of the transaction")
 	balanceAddr := serviceCmd.String("b", "", "The address to get balance for")
+	historyAddr := serviceCmd.String("history", "", "The address to list transactions for")
+	historyOffset := serviceCmd.Int("offset", 0, "Number of newer transactions to skip")
+	historyLimit := serviceCmd.Int("limit", 10, "Maximum number of transactions to list")
 	mineAddr := serviceCmd.String("m", "", "Enable mining mode and send reward to ADDRESS")
+	pruneDepth := serviceCmd.Int("prune", 0, "Keep the transactions of the latest N blocks only")
+	var allocations stringList
+	genesisCreateCmd.Var(&allocations, "alloc", "ADDRESS:AMOUNT the genesis block pays, may be repeated")
+	genesisMessage := genesisCreateCmd.String("message", "", "Coinbase message of the genesis block")
+	genesisName := genesisCreateCmd.String("name", "custom", "Name of the new network")
+	exportFrom := chainExportCmd.Int("from", 0, "Lowest height to export")
+	exportTo := chainExportCmd.Int("to", -1, "Highest height to export, the latest block by default")
+	verifyDepth := chainVerifyCmd.Int("depth", 0, "Number of latest blocks to check, all of them by default")
+	verifyLevel := chainVerifyCmd.Int("level", verifyUTXO, "How thoroughly to check, from 0 to 3")
+	var chainFile, snapshotFile []string
 
 	switch os.Args[1] {
 	case "wallet":
@@ -92,11 +191,116 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "genesis":
+		if len(os.Args) < 3 || os.Args[2] != "create" {
+			cli.printUsage()
+			os.Exit(1)
+		}
+		err := genesisCreateCmd.Parse(os.Args[3:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "chain":
+		if len(os.Args) < 3 {
+			cli.printUsage()
+			os.Exit(1)
+		}
+
+		switch os.Args[2] {
+		case "export":
+			chainFile = parseWithArguments(chainExportCmd, os.Args[3:])
+		case "import":
+			chainFile = parseWithArguments(chainImportCmd, os.Args[3:])
+		case "verify":
+			chainFile = parseWithArguments(chainVerifyCmd, os.Args[3:])
+		}
+		if !chainExportCmd.Parsed() && !chainImportCmd.Parsed() && !chainVerifyCmd.Parsed() || len(chainFile) > 1 ||
+			chainImportCmd.Parsed() && len(chainFile) == 0 || chainVerifyCmd.Parsed() && len(chainFile) > 0 {
+			cli.printUsage()
+			os.Exit(1)
+		}
+	case "utxo":
+		if len(os.Args) < 3 {
+			cli.printUsage()
+			os.Exit(1)
+		}
+
+		switch os.Args[2] {
+		case "dump":
+			snapshotFile = parseWithArguments(utxoDumpCmd, os.Args[3:])
+		case "load":
+			snapshotFile = parseWithArguments(utxoLoadCmd, os.Args[3:])
+		}
+		if !utxoDumpCmd.Parsed() && !utxoLoadCmd.Parsed() || len(snapshotFile) > 1 ||
+			utxoLoadCmd.Parsed() && len(snapshotFile) == 0 {
+			cli.printUsage()
+			os.Exit(1)
+		}
 	default:
 		cli.printUsage()
 		os.Exit(1)
 	}
 
+	var err error
+	if paramsFile != "" {
+		err = LoadChainParams(paramsFile)
+	} else {
+		err = SelectNetwork(network)
+	}
+	if err == nil {
+		err = SelectStorage(storage)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	knownNodes = append([]string{}, activeNetParams.SeedNodes...)
+
+	if genesisCreateCmd.Parsed() {
+		cli.createGenesis(allocations, *genesisMessage, *genesisName)
+		return
+	}
+
+	nodeID := os.Getenv("NODE_ID")
+	if nodeID == "" {
+		nodeID = activeNetParams.DefaultPort
+	}
+
+	// The standard output may be the exported file, nothing else goes there
+	if chainExportCmd.Parsed() {
+		filename := ""
+		if len(chainFile) > 0 {
+			filename = chainFile[0]
+		}
+		cli.exportChain(*exportFrom, *exportTo, filename, nodeID)
+		return
+	}
+	if utxoDumpCmd.Parsed() {
+		filename := ""
+		if len(snapshotFile) > 0 {
+			filename = snapshotFile[0]
+		}
+		cli.dumpSnapshot(filename, nodeID)
+		return
+	}
+
+	if chainVerifyCmd.Parsed() {
+		cli.verifyChain(*verifyDepth, *verifyLevel, nodeID)
+		return
+	}
+
+	CreateGenesisIfNeeded(nodeID)
+
+	if chainImportCmd.Parsed() {
+		cli.importChain(chainFile[0], nodeID)
+		return
+	}
+
+	if utxoLoadCmd.Parsed() {
+		cli.loadSnapshot(snapshotFile[0], nodeID)
+		return
+	}
+
 	if walletCmd.Parsed() {
 		if *createWalletFlag {
 			cli.createWallet(nodeID)
@@ -107,35 +311,88 @@ func (cli *CLI) Run() {
 		}
 
 		if *transferFlag {
-			if *fromAddr == "" || *toAddr == "" || *transferAmount <= 0 {
+			if *fromAddr == "" || *toAddr == "" || *transferAmount <= 0 ||
+				*transferFee < 0 || *transferFeeRate < 0 || (*transferFee > 0 && *transferFeeRate > 0) {
 				walletCmd.Usage()
 				os.Exit(1)
 			}
 
-			cli.send(*fromAddr, *toAddr, *transferAmount, nodeID, *transferMine)
+			cli.send(*fromAddr, *toAddr, *transferAmount, *transferFee, *transferFeeRate, nodeID, *transferMine)
 		}
 	}
 
 	if serviceCmd.Parsed() {
+		if *txIndexFlag {
+			cli.reindexTransactions(nodeID)
+		}
+
+		if *addrIndexFlag {
+			cli.reindexAddresses(nodeID)
+		}
+
+		if *reindexFlag {
+			cli.reindexUTXO(nodeID)
+		}
+
+		if *utxoStatsFlag {
+			cli.printUTXOStats(nodeID)
+		}
+
 		if *startFlag {
-			cli.startNode(nodeID, *mineAddr)
+			if *pruneDepth != 0 && *pruneDepth < minPruneDepth {
+				fmt.Printf("Prune depth must be at least %d blocks\n", minPruneDepth)
+				os.Exit(1)
+			}
+
+			cli.startNode(nodeID, *mineAddr, *pruneDepth)
 		}
 
 		if *printFlag {
-			cli.printChain(nodeID)
+			cli.printChain(*printFrom, *printTo, nodeID)
 		}
 
 		if *balanceAddr != "" && ValidateAddress(*balanceAddr) {
 			cli.getBalance(*balanceAddr, nodeID)
 		}
+
+		if *historyAddr != "" {
+			if *historyOffset < 0 || *historyLimit <= 0 {
+				serviceCmd.Usage()
+				os.Exit(1)
+			}
+
+			cli.printHistory(*historyAddr, *historyOffset, *historyLimit, nodeID)
+		}
 	}
 }
 
-func (cli *CLI) createWallet(nodeID string) {
-	if nodeID == centerNodeId {
-		fmt.Println("Center Node NOT allowed to create wallet")
+func (cli *CLI) createGenesis(allocationArgs []string, message, name string) {
+	var allocations []Allocation
+	for _, arg := range allocationArgs {
+		allocation, err := ParseAllocation(arg)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		allocations = append(allocations, allocation)
+	}
+
+	genesis, params, err := CreateGenesis(allocations, message, name)
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
+
+	blockFile := name + ".blk"
+	paramsFile := name + ".json"
+	genesis.SaveToFile(blockFile)
+	params.SaveToFile(paramsFile)
+
+	fmt.Printf("Genesis block %x\n", genesis.Hash)
+	fmt.Printf("Wrote %s and %s, run nodes with -params %s\n", blockFile, paramsFile, paramsFile)
+}
+
+func (cli *CLI) createWallet(nodeID string) {
 	wallets, _ := NewWallets(nodeID)
 	address := wallets.CreateWallet()
 	wallets.SaveToFile(nodeID)
@@ -164,10 +421,57 @@ func (cli *CLI) getBalance(address, nodeID string) {
 	fmt.Printf("Balance of '%s': %d\n", address, balance)
 }
 
-func (cli *CLI) listAddresses(nodeID string) {
+func (cli *CLI) printHistory(address string, offset, limit int, nodeID string) {
+	if !ValidateAddress(address) {
+		log.Panic("ERROR: Address is not valid")
+	}
+	bc := NewBlockchain(nodeID)
+	defer bc.DB.Close()
+
+	pubKeyHash := Base58Decode([]byte(address))
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
 
-	wallets, err := GetWallets(nodeID)
+	events, total, err := bc.AddressHistory(pubKeyHash, offset, limit)
 	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("History of '%s': %d transactions\n", address, total)
+	for _, event := range events {
+		block, err := bc.GetBlock(event.BlockHash)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		for _, tx := range block.Transactions {
+			if bytes.Equal(tx.ID, event.TxID) {
+				received, sent := bc.AddressAmounts(tx, pubKeyHash)
+				fmt.Printf("Height %d  %x  +%d -%d\n", event.Height, tx.ID, received, sent)
+			}
+		}
+	}
+	if offset+len(events) < total {
+		fmt.Printf("More with -offset %d\n", offset+len(events))
+	}
+}
+
+func (cli *CLI) reindexAddresses(nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.DB.Close()
+
+	if bc.PrunedHeight() > 0 {
+		fmt.Println(errPrunedIndex)
+		os.Exit(1)
+	}
+
+	count := bc.ReindexAddresses()
+	fmt.Printf("Done! There are %d entries in the address index.\n", count)
+}
+
+func (cli *CLI) listAddresses(nodeID string) {
+	wallets, err := NewWallets(nodeID)
+	if err != nil && !os.IsNotExist(err) {
 		log.Panic(err)
 	}
 	addresses := wallets.GetAddresses()
@@ -177,32 +481,228 @@ func (cli *CLI) listAddresses(nodeID string) {
 	}
 }
 
-func (cli *CLI) printChain(nodeID string) {
+func (cli *CLI) printChain(from, to int, nodeID string) {
 	bc := NewBlockchain(nodeID)
 	defer bc.DB.Close()
 
-	bci := bc.Iterator()
+	if bestHeight := bc.GetBestHeight(); to < 0 || to > bestHeight {
+		to = bestHeight
+	}
 
-	for {
-		block := bci.Next()
+	for height := to; height >= from && height >= 0; height-- {
+		block, err := bc.GetBlockByHeight(height)
+		if err != nil {
+			log.Panic(err)
+		}
 
 		fmt.Printf("============ Block %x ============\n", block.Hash)
 		fmt.Printf("Height: %d\n", block.Height)
 		fmt.Printf("Prev. block: %x\n", block.PrevBlockHash)
-		pow := NewProofOfWork(block)
+		pow := NewProofOfWork(&block)
 		fmt.Printf("PoW: %s\n\n", strconv.FormatBool(pow.Validate()))
+		if block.IsPruned() {
+			fmt.Println("Transactions are pruned")
+		}
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
 		}
 		fmt.Printf("\n\n")
+	}
+}
+
+func (cli *CLI) exportChain(from, to int, filename, nodeID string) {
+	var out, progress io.Writer = os.Stdout, os.Stdout
+	if filename == "" || filename == "-" {
+		// Messages printed while the blockchain is opened must not end up
+		// in the chain file
+		progress = os.Stderr
+	}
+
+	bc := openBlockchain(GetDbName(nodeID), progress)
+	defer bc.DB.Close()
+
+	if to < 0 {
+		to = bc.GetBestHeight()
+	}
+
+	if filename != "" && filename != "-" {
+		file, err := os.Create(filename)
+		if err != nil {
+			log.Panic(err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	err := bc.ExportBlocks(out, from, to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d blocks, heights %d to %d\n", to-from+1, from, to)
+}
+
+func (cli *CLI) importChain(filename, nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.DB.Close()
 
-		if len(block.PrevBlockHash) == 0 {
-			break
+	in := os.Stdin
+	if filename != "-" {
+		file, err := os.Open(filename)
+		if err != nil {
+			log.Panic(err)
 		}
+		defer file.Close()
+		in = file
+	}
+
+	imported, known, err := bc.ImportBlocks(in)
+	fmt.Printf("Imported %d blocks, %d were already known, the best height is %d\n", imported, known, bc.GetBestHeight())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 }
 
-func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
+func (cli *CLI) dumpSnapshot(filename, nodeID string) {
+	var out, progress io.Writer = os.Stdout, os.Stdout
+	if filename == "" || filename == "-" {
+		// Messages printed while the blockchain is opened must not end up
+		// in the snapshot
+		progress = os.Stderr
+	}
+
+	bc := openBlockchain(GetDbName(nodeID), progress)
+	defer bc.DB.Close()
+
+	if filename != "" && filename != "-" {
+		file, err := os.Create(filename)
+		if err != nil {
+			log.Panic(err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	header, err := bc.DumpSnapshot(out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	commitment, err := json.Marshal(SnapshotCommitment{header.Height, hex.EncodeToString(header.BlockHash), hex.EncodeToString(header.UTXOHash)})
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Fprintf(os.Stderr, "Dumped the UTXO set of block %x at height %d, %d transactions with hash %x\n",
+		header.BlockHash, header.Height, header.Count, header.UTXOHash)
+	fmt.Fprintf(os.Stderr, "Nodes load it once TrustedSnapshots of network %s has %s\n", header.Network, commitment)
+}
+
+func (cli *CLI) loadSnapshot(filename, nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.DB.Close()
+
+	in := os.Stdin
+	if filename != "-" {
+		file, err := os.Open(filename)
+		if err != nil {
+			log.Panic(err)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	header, err := bc.LoadSnapshot(in)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Loaded the UTXO set of block %x at height %d, %d transactions\n", header.BlockHash, header.Height, header.Count)
+	fmt.Println("Start the node to validate the blocks below it in the background")
+}
+
+func (cli *CLI) reindexUTXO(nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.DB.Close()
+
+	UTXOSet := UTXOSet{bc}
+	err := UTXOSet.Reindex()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	count := UTXOSet.CountTransactions()
+	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
+}
+
+func (cli *CLI) verifyChain(depth, level int, nodeID string) {
+	if depth < 0 || level < verifyHeaders || level > verifyUTXO {
+		fmt.Println("Depth must not be negative and level must be from 0 to 3")
+		os.Exit(1)
+	}
+
+	// The blockchain is checked as it is stored, without the repairs and
+	// upgrades opening it for other commands makes
+	bc, err := openBlockchainReadOnly(GetDbName(nodeID))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer bc.DB.Close()
+
+	checked, err := bc.VerifyChain(depth, level)
+	if chainErr, ok := err.(*ChainError); ok {
+		fmt.Printf("Checked %d blocks at level %d, then found an inconsistency at level %d\n", checked, level, chainErr.Level)
+		fmt.Println(chainErr)
+		os.Exit(2 + chainErr.Level)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Verified %d blocks at level %d, no inconsistencies found\n", checked, level)
+}
+
+func (cli *CLI) printUTXOStats(nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.DB.Close()
+
+	UTXOSet := UTXOSet{bc}
+	stats := UTXOSet.Stats()
+
+	fmt.Printf("Best block:   %x\n", stats.BestBlock)
+	fmt.Printf("Height:       %d\n", stats.Height)
+	fmt.Printf("Transactions: %d\n", stats.Transactions)
+	fmt.Printf("Outputs:      %d\n", stats.Outputs)
+	fmt.Printf("Supply:       %d\n", stats.Supply)
+	fmt.Printf("Emission:     %d\n", stats.Emission)
+	fmt.Printf("Max supply:   %d\n", MaxSupply())
+	fmt.Printf("Size:         %d bytes\n", stats.Size)
+	fmt.Printf("UTXO hash:    %x\n", stats.Hash)
+
+	if stats.Supply > stats.Emission {
+		fmt.Printf("The supply exceeds the emission by %d, the UTXO set is corrupt\n", stats.Supply-stats.Emission)
+		os.Exit(1)
+	}
+}
+
+func (cli *CLI) reindexTransactions(nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.DB.Close()
+
+	if bc.PrunedHeight() > 0 {
+		fmt.Println(errPrunedIndex)
+		os.Exit(1)
+	}
+
+	count := bc.ReindexTransactions()
+	fmt.Printf("Done! There are %d transactions in the transaction index.\n", count)
+}
+
+func (cli *CLI) send(from, to string, amount, fee, feeRate int, nodeID string, mineNow bool) {
 	if !ValidateAddress(from) {
 		log.Panic("ERROR: Sender address is not valid")
 	}
@@ -214,28 +714,41 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 	UTXOSet := UTXOSet{bc}
 	defer bc.DB.Close()
 
-	wallets, err := GetWallets(nodeID)
+	wallets, err := NewWallets(nodeID)
 	if err != nil {
 		log.Panic(err)
 	}
 	wallet := wallets.GetWallet(from)
 
-	tx := NewUTXOTransaction(&wallet, to, amount, &UTXOSet)
+	var tx *Transaction
+	if feeRate > 0 {
+		tx = NewUTXOTransactionAtFeeRate(&wallet, to, amount, feeRate, &UTXOSet)
+	} else {
+		tx = NewUTXOTransaction(&wallet, to, amount, fee, &UTXOSet)
+	}
 
 	if mineNow {
-		cbTx := NewCoinbaseTX(from, "")
+		fee, err := bc.CalculateFee(tx)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cbTx := NewCoinbaseTX(from, "", GetBlockSubsidy(bc.GetBestHeight()+1)+fee)
 		txs := []*Transaction{cbTx, tx}
 
-		newBlock := bc.MineBlock(txs)
-		UTXOSet.Update(newBlock)
+		_, err = bc.MineBlock(txs)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	} else {
-		sendTx(knownNodes[0], tx)
+		sendTx(peers()[0], tx)
 	}
 
 	fmt.Println("Success!")
 }
 
-func (cli *CLI) startNode(nodeID, minerAddress string) {
+func (cli *CLI) startNode(nodeID, minerAddress string, pruneDepth int) {
 	fmt.Printf("Starting node %s\n", nodeID)
 	if len(minerAddress) > 0 {
 		if ValidateAddress(minerAddress) {
@@ -244,5 +757,5 @@ func (cli *CLI) startNode(nodeID, minerAddress string) {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	StartServer(nodeID, minerAddress)
+	StartServer(nodeID, minerAddress, pruneDepth)
 }
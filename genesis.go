@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Allocation is an amount the genesis block pays to an address
+type Allocation struct {
+	Address string
+	Amount  int
+}
+
+// ParseAllocation parses an allocation written as ADDRESS:AMOUNT
+func ParseAllocation(s string) (Allocation, error) {
+	address, amount, found := strings.Cut(s, ":")
+	if !found {
+		return Allocation{}, fmt.Errorf("Allocation %s is not ADDRESS:AMOUNT", s)
+	}
+
+	if !ValidateAddress(address) {
+		return Allocation{}, fmt.Errorf("Address %s is not valid", address)
+	}
+
+	value, err := strconv.Atoi(amount)
+	if err != nil || value <= 0 {
+		return Allocation{}, fmt.Errorf("Amount %s is not a positive number", amount)
+	}
+
+	return Allocation{address, value}, nil
+}
+
+// NewGenesisCoinbaseTX creates the coinbase of a genesis block, paying every
+// allocation with an output of its own
+func NewGenesisCoinbaseTX(allocations []Allocation, data string) *Transaction {
+	txin := TXInput{[]byte{}, -1, nil, []byte(data)}
+	tx := Transaction{nil, []TXInput{txin}, []TXOutput{}}
+
+	for _, allocation := range allocations {
+		tx.Vout = append(tx.Vout, *NewTXOutput(allocation.Amount, allocation.Address))
+	}
+	tx.ID = tx.Hash()
+
+	return &tx
+}
+
+// CreateGenesis mines a genesis block paying the allocations and returns it
+// along with the parameters of a network named name built on it. Everything
+// but the genesis block, the magic and the data directory is taken from the
+// active network.
+func CreateGenesis(allocations []Allocation, message, name string) (*Block, ChainParams, error) {
+	if len(allocations) == 0 {
+		return nil, ChainParams{}, errors.New("Genesis block needs at least one allocation")
+	}
+	if message == "" {
+		return nil, ChainParams{}, errors.New("Genesis block needs a coinbase message")
+	}
+
+	genesis := NewGenesisBlock(NewGenesisCoinbaseTX(allocations, message))
+
+	params := *activeNetParams
+	params.Name = name
+	params.DataDir = name
+	params.GenesisBlockData = hex.EncodeToString(genesis.Serialize())
+
+	// The leading bytes of a block hash are zero, the trailing ones tell
+	// networks apart
+	copy(params.Magic[:], genesis.Hash[len(genesis.Hash)-len(params.Magic):])
+
+	return genesis, params, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Nobody may hold the key to the allocations of the built-in networks
+func TestBuiltInGenesisBlocks(t *testing.T) {
+	for _, params := range networks {
+		t.Run(params.Name, func(t *testing.T) {
+			setParams(t, func(active *ChainParams) { *active = *params })
+
+			genesis := GetGenesisBlock()
+			if !NewProofOfWork(genesis).Validate() || len(genesis.Transactions) != 1 {
+				t.Fatal("Genesis block is invalid")
+			}
+			if coinbase := genesis.Transactions[0]; !bytes.Equal(coinbase.ID, coinbase.Hash()) || !bytes.Equal(genesis.MerkleRoot, genesis.HashTransactions()) {
+				t.Fatal("Genesis block does not hash to its transaction ID and Merkle root")
+			}
+			for i, out := range genesis.Transactions[0].Vout {
+				if !bytes.Equal(out.PubKeyHash, make([]byte, 20)) {
+					t.Errorf("Output %d pays %x", i, out.PubKeyHash)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadChainParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(params *ChainParams)
+		err    string
+	}{
+		{"parameters of genesis create", nil, ""},
+		{"no halving interval", func(params *ChainParams) { params.HalvingInterval = 0 }, "incomplete"},
+		{"retarget interval of 1", func(params *ChainParams) { params.RetargetInterval = 1 }, "at least 2 blocks"},
+		{"no target block interval", func(params *ChainParams) { params.TargetBlockInterval = 0 }, "at least 2 blocks"},
+		{"retarget interval of 1 without retargeting", func(params *ChainParams) {
+			params.RetargetInterval = 1
+			params.NoRetargeting = true
+		}, ""},
+		{"genesis block of another network", func(params *ChainParams) {
+			params.PowLimit = newPowLimit(24)
+		}, "Genesis block"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := *activeNetParams
+			params.NoRetargeting = false
+			if tt.change != nil {
+				tt.change(&params)
+			}
+			filename := filepath.Join(t.TempDir(), "params.json")
+			params.SaveToFile(filename)
+
+			saved := activeNetParams
+			t.Cleanup(func() { activeNetParams = saved })
+			err := LoadChainParams(filename)
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("Load: %v, want %q", err, tt.err)
+			}
+			if (activeNetParams != saved) != (tt.err == "") {
+				t.Error("Active network is not the loaded one only when loading succeeds")
+			}
+		})
+	}
+}
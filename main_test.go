@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// testWallet holds the allocation of the genesis block of the test network
+var testWallet = NewWallet()
+
+// TestMain runs the tests on a network of their own, kept in memory
+func TestMain(m *testing.M) {
+	err := SelectStorage(memoryBackend.Name)
+	if err != nil {
+		panic(err)
+	}
+
+	// Blocks of the test network take little work to mine
+	easy := *activeNetParams
+	easy.PowLimit = newPowLimit(12)
+	activeNetParams = &easy
+
+	_, params, err := CreateGenesis([]Allocation{{string(testWallet.GetAddress()), 10}}, "test", "test")
+	if err != nil {
+		panic(err)
+	}
+	params.DataDir = ""
+	params.NoRetargeting = true
+	activeNetParams = &params
+
+	os.Exit(m.Run())
+}
+
+// setParams changes the parameters of the test network until the test ends
+func setParams(t *testing.T, change func(params *ChainParams)) {
+	saved := *activeNetParams
+	t.Cleanup(func() { *activeNetParams = saved })
+
+	change(activeNetParams)
+}
+
+// testChain is the blockchain of a test node
+type testChain struct {
+	t      *testing.T
+	nodeID string
+	bc     *Blockchain
+	time   int64 // timestamp of the latest block made
+}
+
+// newTestChain creates the blockchain of node nodeID, holding only the
+// genesis block, in a data directory the test shares with its other nodes
+func newTestChain(t *testing.T, nodeID string) *testChain {
+	t.Helper()
+
+	if activeNetParams.DataDir == "" {
+		activeNetParams.DataDir = t.TempDir()
+		t.Cleanup(func() { activeNetParams.DataDir = "" })
+	}
+
+	c := &testChain{t, nodeID, CreateBlockchain(nodeID), GetGenesisBlock().Timestamp}
+	t.Cleanup(func() {
+		c.bc.DB.Close()
+		removeStorage(GetDbName(nodeID))
+	})
+
+	return c
+}
+
+// reopen closes the blockchain and opens it again, as a restarting node does
+func (c *testChain) reopen() {
+	c.bc.DB.Close()
+	c.bc = NewBlockchain(c.nodeID)
+}
+
+func (c *testChain) tip() *Block {
+	return c.bc.mustGetBlock(c.bc.tip)
+}
+
+func (c *testChain) utxo() *UTXOSet {
+	return &UTXOSet{c.bc}
+}
+
+// newBlock makes a block on parent whose coinbase pays to the subsidy and
+// the fees of txs, without adding it
+func (c *testChain) newBlock(parent *Block, to string, txs ...*Transaction) *Block {
+	c.t.Helper()
+
+	reward := GetBlockSubsidy(parent.Height + 1)
+	for _, tx := range txs {
+		fee, err := c.bc.CalculateFee(tx)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		reward += fee
+	}
+	c.time++
+
+	coinbase := NewCoinbaseTX(to, "", reward)
+	return NewBlock(append([]*Transaction{coinbase}, txs...), parent.Hash, parent.Height+1, c.bc.CalcNextBits(parent), c.time)
+}
+
+// add validates and adds a block as a node receiving it does, failing the
+// test when either fails
+func (c *testChain) add(block *Block) {
+	c.t.Helper()
+
+	err := c.bc.ValidateBlock(block)
+	if err == nil {
+		err = c.bc.AddBlock(block)
+	}
+	if err != nil {
+		c.t.Fatalf("Block at height %d: %s", block.Height, err)
+	}
+}
+
+// mine adds a block with txs on the tip
+func (c *testChain) mine(to string, txs ...*Transaction) *Block {
+	c.t.Helper()
+
+	block := c.newBlock(c.tip(), to, txs...)
+	c.add(block)
+
+	return block
+}
+
+// mineBlocks adds n empty blocks on the tip
+func (c *testChain) mineBlocks(n int, to string) {
+	c.t.Helper()
+
+	for i := 0; i < n; i++ {
+		c.mine(to)
+	}
+}
+
+// send makes a transaction paying amount and fee from the outputs of wallet
+func (c *testChain) send(wallet *Wallet, to string, amount, fee int) *Transaction {
+	return NewUTXOTransaction(wallet, to, amount, fee, c.utxo())
+}
+
+func (c *testChain) balance(address string) int {
+	balance := 0
+	for _, out := range c.utxo().FindUTXO(addressPubKeyHash(address)) {
+		balance += out.Value
+	}
+
+	return balance
+}
+
+func addressPubKeyHash(address string) []byte {
+	payload := Base58Decode([]byte(address))
+	return payload[1 : len(payload)-addressChecksumLen]
+}
+
+// newTestWallet returns a wallet and its address
+func newTestWallet() (*Wallet, string) {
+	wallet := NewWallet()
+	return wallet, string(wallet.GetAddress())
+}
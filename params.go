@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+)
+
+// ChainParams defines a network: its genesis block, the consensus rules its
+// blocks follow and how its nodes find each other
+type ChainParams struct {
+	Name        string
+	Magic       [4]byte
+	DefaultPort string
+	SeedNodes   []string
+	DataDir     string
+
+	// Hex of the serialized genesis block
+	GenesisBlockData string
+
+	// The easiest target allowed, also the target of the genesis block.
+	// Every RetargetInterval blocks the target is adjusted so that blocks are
+	// found every TargetBlockInterval seconds on average, unless NoRetargeting.
+	PowLimit            *big.Int
+	RetargetInterval    int
+	TargetBlockInterval int64
+	NoRetargeting       bool
+
+	// Blocks may be timestamped at most MaxFutureBlockTime seconds ahead of
+	// the network-adjusted time
+	MaxFutureBlockTime int64
+
+	// The block reward starts at Subsidy and halves every HalvingInterval
+	// blocks until it is zero, which caps the coins ever created. Coinbase
+	// outputs can be spent once they are CoinbaseMaturity blocks deep.
+	Subsidy          int
+	HalvingInterval  int
+	CoinbaseMaturity int
+
+	AddressVersion byte
+
+	// UTXO snapshots a node may load instead of replaying the blocks below
+	TrustedSnapshots []SnapshotCommitment
+}
+
+// SnapshotCommitment is the UTXO set hash a snapshot of the main chain at
+// Height, whose block is BlockHash, must have. Both hashes are hex.
+type SnapshotCommitment struct {
+	Height    int
+	BlockHash string
+	UTXOHash  string
+}
+
+var mainNetParams = ChainParams{
+	Name:        "mainnet",
+	Magic:       [4]byte{0xf9, 0xbe, 0xb4, 0xd9},
+	DefaultPort: "3000",
+	SeedNodes:   []string{"localhost:3000"},
+	DataDir:     "",
+
+	GenesisBlockData: mainNetGenesisBlockData,
+
+	PowLimit:            newPowLimit(16),
+	RetargetInterval:    10,
+	TargetBlockInterval: 10,
+	MaxFutureBlockTime:  2 * 60 * 60,
+
+	Subsidy:          10,
+	HalvingInterval:  1000,
+	CoinbaseMaturity: 10,
+
+	AddressVersion: 0x00,
+}
+
+var testNetParams = ChainParams{
+	Name:        "testnet",
+	Magic:       [4]byte{0x0b, 0x11, 0x09, 0x07},
+	DefaultPort: "13000",
+	SeedNodes:   []string{"localhost:13000"},
+	DataDir:     "testnet",
+
+	GenesisBlockData: testNetGenesisBlockData,
+
+	PowLimit:            newPowLimit(16),
+	RetargetInterval:    10,
+	TargetBlockInterval: 10,
+	MaxFutureBlockTime:  2 * 60 * 60,
+
+	Subsidy:          10,
+	HalvingInterval:  1000,
+	CoinbaseMaturity: 10,
+
+	AddressVersion: 0x6f,
+}
+
+// Blocks on regtest are cheap to mine, keep the easiest target and may be
+// timestamped a day ahead, so tests can build chains of any shape quickly
+var regTestParams = ChainParams{
+	Name:        "regtest",
+	Magic:       [4]byte{0xfa, 0xbf, 0xb5, 0xda},
+	DefaultPort: "23000",
+	SeedNodes:   []string{"localhost:23000"},
+	DataDir:     "regtest",
+
+	GenesisBlockData: regTestGenesisBlockData,
+
+	PowLimit:            newPowLimit(8),
+	RetargetInterval:    10,
+	TargetBlockInterval: 10,
+	NoRetargeting:       true,
+	MaxFutureBlockTime:  24 * 60 * 60,
+
+	Subsidy:          10,
+	HalvingInterval:  150,
+	CoinbaseMaturity: 10,
+
+	AddressVersion: 0x6f,
+}
+
+var networks = []*ChainParams{&mainNetParams, &testNetParams, &regTestParams}
+
+// activeNetParams are the parameters of the network the node runs on
+var activeNetParams = &mainNetParams
+
+// SelectNetwork makes the network called name the active one
+func SelectNetwork(name string) error {
+	for _, params := range networks {
+		if params.Name == name {
+			activeNetParams = params
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Unknown network %s", name)
+}
+
+// LoadChainParams makes the network described in a chain-params file, as
+// written by genesis create, the active one
+func LoadChainParams(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var params ChainParams
+	err = json.Unmarshal(data, &params)
+	if err != nil {
+		return err
+	}
+
+	if params.Name == "" || params.GenesisBlockData == "" || len(params.SeedNodes) == 0 ||
+		params.PowLimit == nil || params.PowLimit.Sign() <= 0 || params.HalvingInterval <= 0 ||
+		params.MaxFutureBlockTime <= 0 {
+		return fmt.Errorf("Chain parameters in %s are incomplete", filename)
+	}
+	// Retargeting divides by the time the blocks of an interval should have
+	// taken, which is none for intervals of less than 2 blocks
+	if !params.NoRetargeting && (params.RetargetInterval < 2 || params.TargetBlockInterval <= 0) {
+		return fmt.Errorf("Chain parameters in %s retarget every %d blocks to %d seconds, at least 2 blocks and 1 second are needed",
+			filename, params.RetargetInterval, params.TargetBlockInterval)
+	}
+
+	previous := activeNetParams
+	activeNetParams = &params
+	if !NewProofOfWork(GetGenesisBlock()).Validate() {
+		activeNetParams = previous
+		return fmt.Errorf("Genesis block in %s is invalid", filename)
+	}
+
+	return nil
+}
+
+// SaveToFile writes the chain parameters as JSON
+func (params ChainParams) SaveToFile(filename string) {
+	data, err := json.MarshalIndent(params, "", "  ")
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = os.WriteFile(filename, data, 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// dataFile returns the path of a node's data file on the active network
+func dataFile(pattern, nodeID string) string {
+	return filepath.Join(activeNetParams.DataDir, fmt.Sprintf(pattern, nodeID))
+}
+
+// newPowLimit returns the target with the top bits bits of a hash cleared
+func newPowLimit(bits uint) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), 256-bits)
+}
@@ -3,9 +3,7 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
-	"encoding/binary"
 	"fmt"
-	"log"
 	"math"
 	"math/big"
 )
@@ -14,47 +12,63 @@ var (
 	maxNonce = math.MaxInt64
 )
 
-const targetBits = 16
-
 // ProofOfWork represents a proof-of-work
 type ProofOfWork struct {
 	block  *Block
 	target *big.Int
 }
 
-// NewProofOfWork builds and returns a ProofOfWork
+// NewProofOfWork builds and returns a ProofOfWork for the target in the block
 func NewProofOfWork(b *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBits))
+	target := CompactToBig(b.Bits)
 
 	pow := &ProofOfWork{b, target}
 
 	return pow
 }
 
-func IntToHex(num int64) []byte {
-	buff := new(bytes.Buffer)
-	err := binary.Write(buff, binary.BigEndian, num)
-	if err != nil {
-		log.Panic(err)
+// CalcNextBits returns the target a block built on prev has to meet. It only
+// changes every RetargetInterval blocks, scaled by how far the time taken by
+// the last interval is off from TargetBlockInterval per block.
+func (bc *Blockchain) CalcNextBits(prev *Block) uint32 {
+	params := activeNetParams
+	if params.NoRetargeting || (prev.Height+1)%params.RetargetInterval != 0 {
+		return prev.Bits
+	}
+
+	first := prev
+	for i := 0; i < params.RetargetInterval && len(first.PrevBlockHash) > 0; i++ {
+		first = bc.mustGetBlock(first.PrevBlockHash)
+	}
+
+	expected := int64(prev.Height-first.Height) * params.TargetBlockInterval
+	actual := prev.Timestamp - first.Timestamp
+	if actual < expected/4 {
+		actual = expected / 4
+	}
+	if actual > expected*4 {
+		actual = expected * 4
+	}
+
+	target := CompactToBig(prev.Bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+
+	if target.Sign() <= 0 {
+		target.SetInt64(1)
+	}
+	if target.Cmp(params.PowLimit) > 0 {
+		target.Set(params.PowLimit)
 	}
 
-	return buff.Bytes()
+	return BigToCompact(target)
 }
 
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
-	data := bytes.Join(
-		[][]byte{
-			pow.block.PrevBlockHash,
-			pow.block.HashTransactions(),
-			IntToHex(pow.block.Timestamp),
-			IntToHex(int64(targetBits)),
-			IntToHex(int64(nonce)),
-		},
-		[]byte{},
-	)
-
-	return data
+	header := pow.block.BlockHeader
+	header.Nonce = nonce
+
+	return header.Serialize()
 }
 
 // Run performs a proof-of-work
@@ -84,7 +98,56 @@ func (pow *ProofOfWork) Run() (int, []byte) {
 	return nonce, hash[:]
 }
 
-// Validate validates block's PoW
+// CompactToBig converts a target in compact form, a one byte exponent
+// followed by a three byte mantissa, into a big integer
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := int64(compact & 0x007fffff)
+	exponent := uint(compact >> 24)
+
+	if exponent <= 3 {
+		return big.NewInt(mantissa >> (8 * (3 - exponent)))
+	}
+
+	target := big.NewInt(mantissa)
+
+	return target.Lsh(target, 8*(exponent-3))
+}
+
+// BigToCompact converts a target into its compact form
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() <= 0 {
+		return 0
+	}
+
+	exponent := uint(len(target.Bytes()))
+	var mantissa uint32
+
+	if exponent <= 3 {
+		mantissa = uint32(target.Uint64() << (8 * (3 - exponent)))
+	} else {
+		shifted := new(big.Int).Rsh(target, 8*(exponent-3))
+		mantissa = uint32(shifted.Uint64())
+	}
+
+	// The top mantissa bit is a sign bit, keep it clear
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	return uint32(exponent<<24) | mantissa
+}
+
+// Work returns the expected number of hashes needed to find the block
+func (pow *ProofOfWork) Work() *big.Int {
+	limit := new(big.Int).Lsh(big.NewInt(1), 256)
+	denominator := new(big.Int).Add(pow.target, big.NewInt(1))
+
+	return limit.Div(limit, denominator)
+}
+
+// Validate validates block's PoW and checks that it matches the block hash
+// and that the block's target is not easier than the network's PowLimit
 func (pow *ProofOfWork) Validate() bool {
 	var hashInt big.Int
 
@@ -92,7 +155,11 @@ func (pow *ProofOfWork) Validate() bool {
 	hash := sha256.Sum256(data)
 	hashInt.SetBytes(hash[:])
 
-	isValid := hashInt.Cmp(pow.target) == -1
+	if pow.target.Sign() <= 0 || pow.target.Cmp(activeNetParams.PowLimit) > 0 {
+		return false
+	}
+
+	isValid := hashInt.Cmp(pow.target) == -1 && bytes.Equal(hash[:], pow.block.Hash)
 
 	return isValid
 }
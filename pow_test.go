@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestCompactTarget(t *testing.T) {
+	tests := []struct {
+		target  *big.Int
+		compact uint32
+	}{
+		{big.NewInt(0x12), 0x01120000},
+		{big.NewInt(0x80), 0x02008000},
+		{big.NewInt(0x123456), 0x03123456},
+		{big.NewInt(0x12345600), 0x04123456},
+		{newPowLimit(16), 0x1f010000},
+		{newPowLimit(24), 0x1e010000},
+	}
+
+	for _, tt := range tests {
+		if got := BigToCompact(tt.target); got != tt.compact {
+			t.Errorf("BigToCompact(%x) = %08x, want %08x", tt.target, got, tt.compact)
+		}
+		if got := CompactToBig(tt.compact); got.Cmp(tt.target) != 0 {
+			t.Errorf("CompactToBig(%08x) = %x, want %x", tt.compact, got, tt.target)
+		}
+	}
+}
+
+func TestRetarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		spacing  int64 // seconds between blocks, TargetBlockInterval is 10
+		powLimit *big.Int
+		num, den int64 // the new target over the old one
+	}{
+		{"on schedule", 10, newPowLimit(8), 1, 1},
+		{"twice as fast", 5, newPowLimit(8), 1, 2},
+		{"faster than a quarter is clamped", 1, newPowLimit(8), 22, 90},
+		{"slower than four times is clamped", 100, newPowLimit(8), 4, 1},
+		{"never easier than the limit", 100, nil, 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setParams(t, func(params *ChainParams) {
+				params.NoRetargeting = false
+				params.RetargetInterval = 10
+				params.TargetBlockInterval = 10
+				if tt.powLimit != nil {
+					params.PowLimit = tt.powLimit
+				}
+			})
+			c := newTestChain(t, "retarget")
+			_, miner := newTestWallet()
+
+			for i := 1; i < 10; i++ {
+				c.time += tt.spacing - 1
+				block := c.mine(miner)
+				if block.Bits != GetGenesisBlock().Bits {
+					t.Fatalf("Target changed at height %d", block.Height)
+				}
+			}
+
+			want := CompactToBig(GetGenesisBlock().Bits)
+			want.Mul(want, big.NewInt(tt.num))
+			want.Div(want, big.NewInt(tt.den))
+			if got := c.bc.CalcNextBits(c.tip()); got != BigToCompact(want) {
+				t.Fatalf("Next target is %08x, want %08x", got, BigToCompact(want))
+			}
+
+			if tt.num != tt.den {
+				c.time += tt.spacing
+				stale := NewBlock([]*Transaction{NewCoinbaseTX(miner, "", 10)}, c.bc.tip, 10, c.tip().Bits, c.time)
+				if err := c.bc.ValidateBlock(stale); err == nil || !strings.Contains(err.Error(), "Target bits") {
+					t.Fatalf("Block keeping the old target: %v", err)
+				}
+			}
+			c.time += tt.spacing - 1
+			c.mine(miner)
+		})
+	}
+}
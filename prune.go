@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// A pruned blockchain keeps the header of every block but the transactions of
+// the latest blocks only: main chain blocks buried more than pruneDepth blocks
+// deep are stored without their transactions. The unspent outputs of the
+// transactions dropped are kept in the pruned outputs bucket, keyed by
+// outpoint like the UTXO set, so that transactions spending them can still be
+// checked. They are deleted once spent.
+const prunedOutputsBucket = "prunedoutputs"
+
+// minPruneDepth is the deepest reorganization a pruned node is sure to follow
+const minPruneDepth = 10
+
+// The blocks bucket records under prunedHeightKey the lowest main chain
+// height whose block still has its transactions
+var prunedHeightKey = []byte("pruned")
+
+var (
+	errPrunedIndex   = errors.New("Indexes need every block, they cannot be kept on a pruned blockchain")
+	errPrunedFork    = errors.New("Branch forks below the pruned height")
+	errPrunedReindex = errors.New("UTXO set of a pruned blockchain cannot be rebuilt")
+)
+
+// IsPruned tells whether the block is stored without its transactions. Every
+// complete block has at least a coinbase.
+func (b *Block) IsPruned() bool {
+	return len(b.Transactions) == 0
+}
+
+// EnablePruning makes the blockchain drop the transactions of main chain
+// blocks buried more than depth blocks deep, starting with the blocks already
+// buried that deep
+func (bc *Blockchain) EnablePruning(depth int) error {
+	if depth < minPruneDepth {
+		return fmt.Errorf("Prune depth must be at least %d blocks", minPruneDepth)
+	}
+
+	err := bc.DB.Update(func(tx StorageTx) error {
+		if tx.Bucket([]byte(txIndexBucket)) != nil || tx.Bucket([]byte(addrIndexBucket)) != nil {
+			return errPrunedIndex
+		}
+
+		bc.pruneDepth = depth
+		tip := DeserializeBlock(tx.Bucket([]byte(blocksBucket)).Get(bc.tip))
+		bc.pruneBlocks(tx, tip.Height)
+
+		return nil
+	})
+
+	return err
+}
+
+// PrunedHeight returns the lowest main chain height whose block still has its
+// transactions, 0 when no block has been pruned
+func (bc *Blockchain) PrunedHeight() int {
+	height := 0
+
+	err := bc.DB.View(func(tx StorageTx) error {
+		height = prunedHeight(tx)
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return height
+}
+
+func prunedHeight(tx StorageTx) int {
+	h := tx.Bucket([]byte(blocksBucket)).Get(prunedHeightKey)
+	if h == nil {
+		return 0
+	}
+
+	return int(binary.BigEndian.Uint64(h))
+}
+
+// pruneBlocks drops the transactions of the main chain blocks buried more
+// than pruneDepth blocks under height, along with their undo data
+func (bc *Blockchain) pruneBlocks(tx StorageTx, height int) {
+	if bc.pruneDepth == 0 {
+		return
+	}
+
+	from := prunedHeight(tx)
+	to := height - bc.pruneDepth
+	if to < from {
+		return
+	}
+
+	b := tx.Bucket([]byte(blocksBucket))
+	hb := tx.Bucket([]byte(heightBucket))
+	ub := tx.Bucket([]byte(undoBucket))
+	cb := tx.Bucket([]byte(utxoBucket))
+	ob, err := tx.CreateBucketIfNotExists([]byte(prunedOutputsBucket))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	for h := from; h <= to; h++ {
+		hash := hb.Get(heightKey(h))
+		block := DeserializeBlock(b.Get(hash))
+
+		for _, transaction := range block.Transactions {
+			for outIdx := range transaction.Vout {
+				key := outpointKey(transaction.ID, outIdx)
+				entry := cb.Get(key)
+				if entry == nil {
+					continue
+				}
+
+				err := ob.Put(key, entry)
+				if err != nil {
+					log.Panic(err)
+				}
+			}
+		}
+
+		if ub != nil {
+			err := ub.Delete(hash)
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+
+		header := Block{block.BlockHeader, nil, block.Hash, block.Height}
+		err := b.Put(hash, header.Serialize())
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	err = b.Put(prunedHeightKey, heightKey(to+1))
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Pruned blocks up to height %d\n", to)
+}
+
+// findPrunedTransaction returns the unspent outputs of a transaction of a
+// pruned block, as a transaction without inputs whose spent outputs are empty
+func (bc *Blockchain) findPrunedTransaction(ID []byte) (*Transaction, bool) {
+	var transaction *Transaction
+
+	err := bc.DB.View(func(tx StorageTx) error {
+		ob := tx.Bucket([]byte(prunedOutputsBucket))
+		if ob == nil {
+			return nil
+		}
+
+		c := ob.Cursor()
+		for k, v := c.Seek(ID); k != nil && len(k) == len(ID)+4 && bytes.HasPrefix(k, ID); k, v = c.Next() {
+			if transaction == nil {
+				transaction = &Transaction{append([]byte{}, ID...), nil, nil}
+			}
+
+			_, vout := splitOutpointKey(k)
+			for len(transaction.Vout) <= vout {
+				transaction.Vout = append(transaction.Vout, TXOutput{})
+			}
+			transaction.Vout[vout] = DeserializeUTXOEntry(v).Output
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return transaction, transaction != nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPrunedOutputs(t *testing.T) {
+	genesisOutpoint := outpointKey(GetGenesisBlock().Transactions[0].ID, 0)
+
+	tests := []struct {
+		name  string
+		build func(c *testChain, to string)
+		kept  bool // the genesis allocation is a pruned output
+	}{
+		{"unspent outputs are kept", func(c *testChain, to string) {
+			c.mineBlocks(15, to)
+		}, true},
+		{"outputs spent before pruning are dropped", func(c *testChain, to string) {
+			c.mine(to, c.send(testWallet, to, 7, 0))
+			c.mineBlocks(15, to)
+		}, false},
+		{"outputs spent after pruning are deleted", func(c *testChain, to string) {
+			c.mineBlocks(15, to)
+			c.mine(to, c.send(testWallet, to, 7, 0))
+		}, false},
+		{"outputs are restored when their spending block is disconnected", func(c *testChain, to string) {
+			c.mineBlocks(15, to)
+			parent := c.tip()
+			c.mine(to, c.send(testWallet, to, 7, 0))
+
+			branch := c.newBlock(parent, to)
+			c.add(branch)
+			c.add(c.newBlock(branch, to))
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "prune")
+			_, miner := newTestWallet()
+			if err := c.bc.EnablePruning(minPruneDepth); err != nil {
+				t.Fatal(err)
+			}
+			tt.build(c, miner)
+
+			if c.bc.PrunedHeight() == 0 {
+				t.Fatal("No block is pruned")
+			}
+			kept := checkPrunedOutputs(t, c)
+			if kept[string(genesisOutpoint)] != tt.kept {
+				t.Errorf("Genesis allocation kept: %v", !tt.kept)
+			}
+		})
+	}
+}
+
+// checkPrunedOutputs checks that the pruned outputs are the outputs of the
+// UTXO set below the pruned height and returns their keys
+func checkPrunedOutputs(t *testing.T, c *testChain) map[string]bool {
+	t.Helper()
+
+	kept := make(map[string]bool)
+	c.bc.DB.View(func(tx StorageTx) error {
+		pruned := prunedHeight(tx)
+		ub := tx.Bucket([]byte(utxoBucket))
+		ob := tx.Bucket([]byte(prunedOutputsBucket))
+
+		c := ob.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			kept[string(k)] = true
+			if !bytes.Equal(ub.Get(k), v) {
+				t.Errorf("Pruned output %x is not in the UTXO set", k)
+			}
+		}
+
+		c = ub.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if !bytes.Equal(k, bestBlockKey) && DeserializeUTXOEntry(v).Height < pruned && !kept[string(k)] {
+				t.Errorf("Output %x of a pruned block is missing", k)
+			}
+		}
+
+		return nil
+	})
+
+	return kept
+}
+
+// The chainstate of a node stopped between applying a block of another branch
+// and moving the tip is repaired when the blockchain is opened
+func TestRepairChainstateOnBranch(t *testing.T) {
+	tests := []struct {
+		name   string
+		prune  bool
+		noUndo bool // the undo record of the branch block is lost
+		err    string
+	}{
+		{"rolled back with undo records", false, false, ""},
+		{"rolled back on a pruned blockchain", true, false, ""},
+		{"rebuilt without undo records", false, true, ""},
+		{"no undo records on a pruned blockchain", true, true, "cannot be repaired"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "repair")
+			_, miner := newTestWallet()
+			if tt.prune {
+				if err := c.bc.EnablePruning(minPruneDepth); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c.mineBlocks(12, miner)
+			parent := c.tip()
+			c.mine(miner, c.send(testWallet, miner, 7, 0))
+			_, hash := c.bc.UTXOSnapshot()
+
+			// The branch block is stored, then applied in place of the tip
+			branch := c.newBlock(parent, miner)
+			if err := c.bc.AddBlock(branch); err != nil {
+				t.Fatal(err)
+			}
+			tip := c.tip()
+			UTXOSet := c.utxo()
+			undo := UTXOSet.blockUndo(tip)
+			update(t, c.bc.DB, func(tx StorageTx) error {
+				UTXOSet.disconnect(tx, tip, undo)
+				UTXOSet.connect(tx, branch)
+				if tt.noUndo {
+					return tx.Bucket([]byte(undoBucket)).Delete(branch.Hash)
+				}
+				return nil
+			})
+
+			err := c.bc.checkChainstate()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Repair: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, got := c.bc.UTXOSnapshot(); !bytes.Equal(got, hash) {
+				t.Fatal("UTXO set differs from the one of the tip")
+			}
+			if tt.prune {
+				checkPrunedOutputs(t, c)
+			}
+		})
+	}
+}
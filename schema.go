@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+)
+
+// The meta bucket records the schema version of a database and the network
+// its blocks belong to. Databases written before it existed have schema
+// version 0 and are refused.
+const metaBucket = "meta"
+
+var (
+	schemaVersionKey = []byte("version")
+	networkKey       = []byte("network")
+	genesisKey       = []byte("genesis")
+)
+
+// migration upgrades a database from the schema version before Version to
+// Version. It runs in one transaction, so a migration that fails leaves the
+// database as it was.
+type migration struct {
+	Version     int
+	Description string
+	Migrate     func(tx StorageTx) error
+}
+
+// migrations upgrade databases to schemaVersion, in order, starting with the
+// one to version 2. Any change to the layout of stored blocks, the chainstate
+// or the indexes bumps schemaVersion and adds the migration to it here.
+var migrations = []migration{}
+
+var schemaVersion = 1 + len(migrations)
+
+// putMeta records that the database has the schema version and belongs to
+// the active network
+func putMeta(tx StorageTx, version int) {
+	b, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = b.Put(schemaVersionKey, binary.BigEndian.AppendUint32(nil, uint32(version)))
+	if err == nil {
+		err = b.Put(networkKey, []byte(activeNetParams.Name))
+	}
+	if err == nil {
+		err = b.Put(genesisKey, GetGenesisBlock().Hash)
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// readMeta returns the schema version of the database and the name and
+// genesis block of its network
+func readMeta(db Storage) (version int, network string, genesis []byte) {
+	err := db.View(func(tx StorageTx) error {
+		b := tx.Bucket([]byte(metaBucket))
+		if b == nil {
+			return nil
+		}
+
+		if v := b.Get(schemaVersionKey); len(v) == 4 {
+			version = int(binary.BigEndian.Uint32(v))
+		}
+		network = string(b.Get(networkKey))
+		genesis = append([]byte{}, b.Get(genesisKey)...)
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return version, network, genesis
+}
+
+// incompatibleRelease is the error of a database without a schema version.
+// Those were written by releases that kept the UTXO set per transaction and
+// hashed transactions differently, so their blocks cannot be migrated.
+func incompatibleRelease(dbFile string) error {
+	return fmt.Errorf("Database %s was written by an incompatible release of this program. Move it away and sync the blockchain again", dbFile)
+}
+
+// upgradeStorage checks that the database at dbFile, opened as db, is for the
+// active network and has the current schema. An older database is copied to
+// a backup and migrated in place, reporting to progress; the storage to use
+// from then on is returned.
+func upgradeStorage(dbFile string, db Storage, progress io.Writer) (Storage, error) {
+	version, network, genesis := readMeta(db)
+
+	if version == 0 {
+		return db, incompatibleRelease(dbFile)
+	}
+	if !bytes.Equal(genesis, GetGenesisBlock().Hash) {
+		return db, fmt.Errorf("Database %s is for network %s, not %s", dbFile, network, activeNetParams.Name)
+	}
+	if version > schemaVersion {
+		return db, fmt.Errorf("Database %s has schema version %d, this program only reads versions up to %d", dbFile, version, schemaVersion)
+	}
+	if version == schemaVersion {
+		return db, nil
+	}
+
+	err := db.Close()
+	if err != nil {
+		return db, err
+	}
+
+	backup := fmt.Sprintf("%s.v%d.bak", dbFile, version)
+	err = copyStorage(dbFile, backup)
+	if err != nil {
+		return db, fmt.Errorf("Backing up database %s failed: %s", dbFile, err)
+	}
+	fmt.Fprintf(progress, "Upgrading database %s from schema version %d to %d, backed up to %s\n", dbFile, version, schemaVersion, backup)
+
+	db, err = OpenStorage(dbFile)
+	if err != nil {
+		return db, err
+	}
+
+	for _, m := range migrations[version-1:] {
+		fmt.Fprintf(progress, "Schema version %d: %s\n", m.Version, m.Description)
+
+		err = db.Update(func(tx StorageTx) error {
+			err := m.Migrate(tx)
+			if err != nil {
+				return err
+			}
+
+			putMeta(tx, m.Version)
+
+			return nil
+		})
+		if err != nil {
+			return db, fmt.Errorf("Upgrading database %s to schema version %d failed: %s. It is unchanged since version %d, the backup is %s",
+				dbFile, m.Version, err, m.Version-1, backup)
+		}
+	}
+
+	return db, nil
+}
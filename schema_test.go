@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestUpgradeStorage(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(tx StorageTx) error
+		migrate func(tx StorageTx) error // migration to a version 2 of the schema, nil for none
+		err     string
+		version int // schema version left when the upgrade fails
+	}{
+		{"current schema", func(tx StorageTx) error { return nil }, nil, "", 0},
+		{"unversioned database", func(tx StorageTx) error {
+			return tx.DeleteBucket([]byte(metaBucket))
+		}, nil, "incompatible release", 0},
+		{"newer schema version", func(tx StorageTx) error {
+			return tx.Bucket([]byte(metaBucket)).Put(schemaVersionKey, binary.BigEndian.AppendUint32(nil, 99))
+		}, nil, "schema version 99", 99},
+		{"other network", func(tx StorageTx) error {
+			return tx.Bucket([]byte(metaBucket)).Put(genesisKey, []byte("other"))
+		}, nil, "is for network", 1},
+		{"older schema", func(tx StorageTx) error { return nil }, func(tx StorageTx) error {
+			return tx.Bucket([]byte(metaBucket)).Put([]byte("migrated"), []byte{1})
+		}, "", 0},
+		{"migration failing", func(tx StorageTx) error { return nil }, func(tx StorageTx) error {
+			tx.Bucket([]byte(metaBucket)).Put([]byte("migrated"), []byte{1})
+			return errors.New("broken")
+		}, "to schema version 2 failed: broken", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.migrate != nil {
+				saved := migrations
+				migrations = []migration{{2, "test", tt.migrate}}
+				schemaVersion = 2
+				t.Cleanup(func() {
+					migrations = saved
+					schemaVersion = 1 + len(migrations)
+				})
+			}
+
+			c := newTestChain(t, "schema")
+			dbFile := GetDbName(c.nodeID)
+			backup := dbFile + ".v1.bak"
+			t.Cleanup(func() { removeStorage(backup) })
+			_, miner := newTestWallet()
+			c.mineBlocks(3, miner)
+			update(t, c.bc.DB, tt.change)
+			if tt.migrate != nil {
+				update(t, c.bc.DB, func(tx StorageTx) error {
+					putMeta(tx, 1)
+					return nil
+				})
+			}
+			c.bc.DB.Close()
+
+			db, err := OpenStorage(dbFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, err = upgradeStorage(dbFile, db, io.Discard)
+			c.bc.DB = db
+
+			version, _, _ := readMeta(db)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Upgrade: %v, want %q", err, tt.err)
+				}
+				if version != tt.version {
+					t.Errorf("Schema version is %d, want it unchanged at %d", version, tt.version)
+				}
+				if migrated := migratedKey(t, db); migrated {
+					t.Error("Failed migration is not rolled back")
+				}
+				if tt.migrate == nil && (storageExists(dbFile+".v0.bak") || storageExists(backup)) {
+					t.Error("Database refused is backed up")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if version != schemaVersion {
+				t.Fatalf("Schema version is %d", version)
+			}
+			if tt.migrate != nil && (!migratedKey(t, db) || !storageExists(backup)) {
+				t.Error("Database is not backed up and migrated")
+			}
+			if block, err := c.bc.GetBlockByHeight(3); err != nil || !bytes.Equal(block.Hash, c.bc.tip) {
+				t.Errorf("Height index: %v", err)
+			}
+		})
+	}
+}
+
+// migratedKey reports whether the test migration wrote its key
+func migratedKey(t *testing.T, db Storage) bool {
+	t.Helper()
+
+	migrated := false
+	err := db.View(func(tx StorageTx) error {
+		if b := tx.Bucket([]byte(metaBucket)); b != nil {
+			migrated = b.Get([]byte("migrated")) != nil
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return migrated
+}
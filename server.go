@@ -8,19 +8,54 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
 const protocol = "tcp"
 const nodeVersion = 1
 const commandLength = 12
-const centerNodeId = "3000"
-
+const magicLength = 4
+const banThreshold = 100
+const invalidBlockScore = 100
+const maxOrphanBlocks = 100
+const maxInvHashes = 500
+const maxMessageSize = magicLength + commandLength + maxBlockSize + 1024
+
+// The address of the node and of the peers it knows, changed by concurrent
+// connections. They are only read and written under nodesLock.
 var nodeAddress string
+var knownNodes = append([]string{}, mainNetParams.SeedNodes...)
+var nodesLock sync.Mutex
+
 var miningAddress string
-var knownNodes = []string{fmt.Sprintf("localhost:%s", centerNodeId)}
-var blocksInTransit = [][]byte{}
 var mempool = make(map[string]Transaction)
 
+// Misbehaviour scores of peers keyed by the host they connect from, written
+// by concurrent connections
+var misbehaving = make(map[string]int)
+var misbehavingLock sync.Mutex
+
+// The last block announced to each peer in an inventory that had to leave
+// blocks out, written by concurrent connections
+var continueHashes = make(map[string][]byte)
+var continueLock sync.Mutex
+
+// Blocks whose parent is not known yet, keyed by the parent hash
+var orphans = make(map[string][]orphanBlock)
+var orphanCount = 0
+var orphansLock sync.Mutex
+
+// snapshotCheck validates the blocks below the UTXO snapshot the node was
+// started from, nil when there is none
+var snapshotCheck *snapshotValidation
+
+type orphanBlock struct {
+	Block    *Block
+	AddrFrom string
+	Host     string
+}
+
 // type addr struct {
 // 	AddrList []string
 // }
@@ -56,6 +91,9 @@ type verzion struct {
 	Version    int
 	BestHeight int
 	AddrFrom   string
+	Timestamp  int64
+	// Lowest height the node can serve blocks from, 0 for a full node
+	PrunedHeight int
 }
 
 func commandToBytes(command string) []byte {
@@ -100,7 +138,7 @@ func bytesToCommand(bytes []byte) string {
 // }
 
 func sendBlock(addr string, b *Block) {
-	data := block{nodeAddress, b.Serialize()}
+	data := block{localAddress(), b.Serialize()}
 	payload := gobEncode(data)
 	request := append(commandToBytes("block"), payload...)
 
@@ -111,27 +149,21 @@ func sendData(addr string, data []byte) {
 	conn, err := net.Dial(protocol, addr)
 	if err != nil {
 		fmt.Printf("%s is not available\n", addr)
-		var updatedNodes []string
-
-		for _, node := range knownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
-			}
-		}
-
-		knownNodes = updatedNodes
+		forgetNode(addr)
 		return
 	}
 	defer conn.Close()
 
-	_, err = io.Copy(conn, bytes.NewReader(data))
+	// Every message starts with the magic of the network it belongs to
+	message := append(activeNetParams.Magic[:], data...)
+	_, err = io.Copy(conn, bytes.NewReader(message))
 	if err != nil {
 		log.Panic(err)
 	}
 }
 
 func sendInv(address, kind string, items [][]byte) {
-	inventory := inv{nodeAddress, kind, items}
+	inventory := inv{localAddress(), kind, items}
 	payload := gobEncode(inventory)
 	request := append(commandToBytes("inv"), payload...)
 
@@ -139,21 +171,29 @@ func sendInv(address, kind string, items [][]byte) {
 }
 
 func sendGetBlocks(address string, myBestHeight int) {
-	payload := gobEncode(getblocks{nodeAddress, myBestHeight})
+	payload := gobEncode(getblocks{localAddress(), myBestHeight})
 	request := append(commandToBytes("getblocks"), payload...)
 
 	sendData(address, request)
 }
 
 func sendGetData(address, kind string, id []byte) {
-	payload := gobEncode(getdata{nodeAddress, kind, id})
+	payload := gobEncode(getdata{localAddress(), kind, id})
 	request := append(commandToBytes("getdata"), payload...)
 
 	sendData(address, request)
 }
 
+// sendNotFound tells a peer that asked for an item that it cannot be served
+func sendNotFound(address, kind string, id []byte) {
+	payload := gobEncode(getdata{localAddress(), kind, id})
+	request := append(commandToBytes("notfound"), payload...)
+
+	sendData(address, request)
+}
+
 func sendTx(addr string, tnx *Transaction) {
-	data := tx{nodeAddress, tnx.Serialize()}
+	data := tx{localAddress(), tnx.Serialize()}
 	payload := gobEncode(data)
 	request := append(commandToBytes("tx"), payload...)
 
@@ -162,7 +202,7 @@ func sendTx(addr string, tnx *Transaction) {
 
 func sendVersion(addr string, bc *Blockchain) {
 	bestHeight := bc.GetBestHeight()
-	payload := gobEncode(verzion{nodeVersion, bestHeight, nodeAddress})
+	payload := gobEncode(verzion{nodeVersion, bestHeight, localAddress(), time.Now().Unix(), bc.PrunedHeight()})
 
 	request := append(commandToBytes("version"), payload...)
 
@@ -191,7 +231,7 @@ func sendVersion(addr string, bc *Blockchain) {
 // 	// requestBlocks()
 // }
 
-func handleBlock(request []byte, bc *Blockchain) {
+func handleBlock(request []byte, bc *Blockchain, host string) {
 	var buff bytes.Buffer
 	var payload block
 
@@ -199,29 +239,120 @@ func handleBlock(request []byte, bc *Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		fmt.Printf("Block message from %s cannot be decoded: %s\n", host, err)
+		markPeer(host, "", banThreshold)
+		return
 	}
 
-	blockData := payload.Block
-	block := DeserializeBlock(blockData)
+	block, err := decodeBlock(payload.Block)
+	if err != nil {
+		fmt.Printf("Block from %s cannot be decoded: %s\n", host, err)
+		markPeer(host, payload.AddrFrom, banThreshold)
+		return
+	}
 
-	fmt.Println("Recevied a new block!")
-	bc.AddBlock(block)
+	if snapshotCheck != nil && snapshotCheck.wants(bc, block) {
+		snapshotCheck.deliver(block)
+	} else {
+		fmt.Println("Recevied a new block!")
+		processBlock(bc, block, payload.AddrFrom, host)
+	}
+
+}
+
+// processBlock validates and stores a block, keeps it in the orphan pool when
+// its parent is unknown and then connects the orphans that were waiting for it.
+// addrFrom is the address the sender listens on, host the one it connected
+// from.
+func processBlock(bc *Blockchain, block *Block, addrFrom, host string) {
+	err := bc.ValidateBlock(block)
+	if err == errOrphanBlock {
+		if addOrphan(block, addrFrom, host) {
+			fmt.Printf("Keeping orphan block %x, asking %s for its ancestors\n", block.Hash, addrFrom)
+			sendGetBlocks(addrFrom, bc.GetBestHeight())
+		}
+
+		// The parent may have been added while the block was being checked
+		if _, err := bc.GetBlock(block.PrevBlockHash); err == nil {
+			for _, orphan := range takeOrphans(block.PrevBlockHash) {
+				processBlock(bc, orphan.Block, orphan.AddrFrom, orphan.Host)
+			}
+		}
+		return
+	}
+	if err == nil {
+		err = bc.AddBlock(block)
+	}
+	if err != nil {
+		fmt.Printf("Rejected block %x from %s: %s\n", block.Hash, addrFrom, err)
+		if err != errFutureBlock && err != errPrunedFork {
+			markPeer(host, addrFrom, invalidBlockScore)
+		}
+		return
+	}
 
 	fmt.Printf("Added block %x\n", block.Hash)
 
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
+	for _, orphan := range takeOrphans(block.Hash) {
+		processBlock(bc, orphan.Block, orphan.AddrFrom, orphan.Host)
+	}
+}
 
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := UTXOSet{bc}
-		UTXOSet.Reindex()
+// addOrphan puts a block into the orphan pool, evicting another one when
+// the pool is full. It reports false if the block was already there.
+func addOrphan(block *Block, addrFrom, host string) bool {
+	orphansLock.Lock()
+	defer orphansLock.Unlock()
+
+	if isOrphan(block.Hash) {
+		return false
+	}
+
+	if orphanCount >= maxOrphanBlocks {
+		for parent, children := range orphans {
+			if len(children) > 1 {
+				orphans[parent] = children[1:]
+			} else {
+				delete(orphans, parent)
+			}
+			orphanCount--
+			break
+		}
+	}
+
+	parent := hex.EncodeToString(block.PrevBlockHash)
+	orphans[parent] = append(orphans[parent], orphanBlock{block, addrFrom, host})
+	orphanCount++
+
+	return true
+}
+
+// takeOrphans removes and returns the orphans whose parent is blockHash
+func takeOrphans(blockHash []byte) []orphanBlock {
+	orphansLock.Lock()
+	defer orphansLock.Unlock()
+
+	parent := hex.EncodeToString(blockHash)
+	children := orphans[parent]
+	delete(orphans, parent)
+	orphanCount -= len(children)
+
+	return children
+}
+
+func isOrphan(blockHash []byte) bool {
+	for _, children := range orphans {
+		for _, orphan := range children {
+			if bytes.Equal(orphan.Block.Hash, blockHash) {
+				return true
+			}
+		}
 	}
+
+	return false
 }
 
-func handleInv(request []byte) {
+func handleInv(request []byte, bc *Blockchain) {
 	var buff bytes.Buffer
 	var payload inv
 
@@ -235,28 +366,26 @@ func handleInv(request []byte) {
 	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
 
 	if payload.Type == "block" {
-		// blocksInTransit = payload.Items
-
-		// blockHash := payload.Items[0]
-		// sendGetData(payload.AddrFrom, "block", blockHash)
-
-		// newInTransit := [][]byte{}
-		// for _, b := range blocksInTransit {
-		// 	if !bytes.Equal(b, blockHash) {
-		// 		newInTransit = append(newInTransit, b)
-		// 	}
-		// }
-		// blocksInTransit = newInTransit
 		for _, blockHash := range payload.Items {
-			sendGetData(payload.AddrFrom, "block", blockHash)
+			if _, err := bc.GetBlock(blockHash); err == nil {
+				continue
+			}
+
+			orphansLock.Lock()
+			known := isOrphan(blockHash)
+			orphansLock.Unlock()
+
+			if !known {
+				sendGetData(payload.AddrFrom, "block", blockHash)
+			}
 		}
 	}
 
 	if payload.Type == "tx" {
-		txID := payload.Items[0]
-
-		if mempool[hex.EncodeToString(txID)].ID == nil {
-			sendGetData(payload.AddrFrom, "tx", txID)
+		for _, txID := range payload.Items {
+			if mempool[hex.EncodeToString(txID)].ID == nil {
+				sendGetData(payload.AddrFrom, "tx", txID)
+			}
 		}
 	}
 }
@@ -272,8 +401,30 @@ func handleGetBlocks(request []byte, bc *Blockchain) {
 		log.Panic(err)
 	}
 
-	blocks := bc.GetBlockHashes(payload.Height)
-	sendInv(payload.AddrFrom, "block", blocks)
+	// A pruned node only offers the blocks it still has the transactions of
+	height := payload.Height
+	if prunedHeight := bc.PrunedHeight(); height < prunedHeight-1 {
+		height = prunedHeight - 1
+	}
+
+	sendBlockInv(payload.AddrFrom, bc, height)
+}
+
+// sendBlockInv announces to addr the main chain blocks above height, at most
+// maxInvHashes of them. When more are left, the next ones are announced once
+// addr asks for the last block announced.
+func sendBlockInv(addr string, bc *Blockchain, height int) {
+	blocks := bc.GetBlockHashes(height, maxInvHashes)
+
+	continueLock.Lock()
+	if len(blocks) == maxInvHashes {
+		continueHashes[addr] = blocks[len(blocks)-1]
+	} else {
+		delete(continueHashes, addr)
+	}
+	continueLock.Unlock()
+
+	sendInv(addr, "block", blocks)
 }
 
 func handleGetData(request []byte, bc *Blockchain) {
@@ -292,8 +443,19 @@ func handleGetData(request []byte, bc *Blockchain) {
 		if err != nil {
 			return
 		}
+		if block.IsPruned() {
+			sendNotFound(payload.AddrFrom, payload.Type, payload.ID)
+			return
+		}
 
 		sendBlock(payload.AddrFrom, &block)
+
+		continueLock.Lock()
+		last := bytes.Equal(continueHashes[payload.AddrFrom], block.Hash)
+		continueLock.Unlock()
+		if last {
+			sendBlockInv(payload.AddrFrom, bc, block.Height)
+		}
 	}
 
 	if payload.Type == "tx" {
@@ -305,6 +467,20 @@ func handleGetData(request []byte, bc *Blockchain) {
 	}
 }
 
+func handleNotFound(request []byte) {
+	var buff bytes.Buffer
+	var payload getdata
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("%s cannot serve %s %x\n", payload.AddrFrom, payload.Type, payload.ID)
+}
+
 func handleTx(request []byte, bc *Blockchain) {
 	var buff bytes.Buffer
 	var payload tx
@@ -320,9 +496,10 @@ func handleTx(request []byte, bc *Blockchain) {
 	tx := DeserializeTransaction(txData)
 	mempool[hex.EncodeToString(tx.ID)] = tx
 
-	if nodeAddress == knownNodes[0] {
-		for _, node := range knownNodes {
-			if node != nodeAddress && node != payload.AddFrom {
+	self, nodes := localAddress(), peers()
+	if len(nodes) > 0 && self == nodes[0] {
+		for _, node := range nodes {
+			if node != self && node != payload.AddFrom {
 				sendInv(node, "tx", [][]byte{tx.ID})
 			}
 		}
@@ -333,22 +510,33 @@ func handleTx(request []byte, bc *Blockchain) {
 
 			for id := range mempool {
 				tx := mempool[id]
-				if bc.VerifyTransaction(&tx) {
-					txs = append(txs, &tx)
-				}
+				txs = append(txs, &tx)
 			}
 
+			txs = bc.SelectTransactions(txs)
 			if len(txs) == 0 {
-				fmt.Println("All transactions are invalid! Waiting for new ones...")
+				fmt.Println("No transaction is valid and fits into a block! Waiting for new ones...")
 				return
 			}
 
-			cbTx := NewCoinbaseTX(miningAddress, "")
+			fees := 0
+			for _, tx := range txs {
+				fee, err := bc.CalculateFee(tx)
+				if err != nil {
+					fmt.Printf("Block cannot be mined: %s\n", err)
+					return
+				}
+				fees += fee
+			}
+
+			cbTx := NewCoinbaseTX(miningAddress, "", GetBlockSubsidy(bc.GetBestHeight()+1)+fees)
 			txs = append(txs, cbTx)
 
-			newBlock := bc.MineBlock(txs)
-			UTXOSet := UTXOSet{bc}
-			UTXOSet.Reindex()
+			newBlock, err := bc.MineBlock(txs)
+			if err != nil {
+				fmt.Printf("Block cannot be mined: %s\n", err)
+				return
+			}
 
 			fmt.Println("New block is mined!")
 
@@ -357,8 +545,8 @@ func handleTx(request []byte, bc *Blockchain) {
 				delete(mempool, txID)
 			}
 
-			for _, node := range knownNodes {
-				if node != nodeAddress {
+			for _, node := range peers() {
+				if node != self {
 					sendInv(node, "block", [][]byte{newBlock.Hash})
 				}
 			}
@@ -370,7 +558,7 @@ func handleTx(request []byte, bc *Blockchain) {
 	}
 }
 
-func handleVersion(request []byte, bc *Blockchain) {
+func handleVersion(request []byte, bc *Blockchain, host string) {
 	var buff bytes.Buffer
 	var payload verzion
 
@@ -381,26 +569,49 @@ func handleVersion(request []byte, bc *Blockchain) {
 		log.Panic(err)
 	}
 
+	if payload.Timestamp != 0 {
+		addTimeSample(host, payload.Timestamp)
+	}
+
 	myBestHeight := bc.GetBestHeight()
 	foreignerBestHeight := payload.BestHeight
 
-	if myBestHeight < foreignerBestHeight {
+	if myBestHeight < foreignerBestHeight && payload.PrunedHeight > myBestHeight+1 {
+		fmt.Printf("%s has pruned the blocks below height %d, cannot sync from it\n", payload.AddrFrom, payload.PrunedHeight)
+	} else if myBestHeight < foreignerBestHeight {
 		sendGetBlocks(payload.AddrFrom, myBestHeight)
 	} else if myBestHeight > foreignerBestHeight {
 		sendVersion(payload.AddrFrom, bc)
 	}
 
 	// sendAddr(payload.AddrFrom)
-	if !nodeIsKnown(payload.AddrFrom) {
-		knownNodes = append(knownNodes, payload.AddrFrom)
-	}
+	addNode(payload.AddrFrom)
 }
 
 func handleConnection(conn net.Conn, bc *Blockchain) {
-	request, err := io.ReadAll(conn)
+	request, err := io.ReadAll(io.LimitReader(conn, maxMessageSize+1))
 	if err != nil {
 		log.Panic(err)
 	}
+	if len(request) > maxMessageSize || len(request) < magicLength+commandLength {
+		fmt.Printf("Dropped an oversized or truncated message from %s\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if !bytes.Equal(request[:magicLength], activeNetParams.Magic[:]) {
+		fmt.Printf("Dropped a message from %s on another network\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	// Peers are told apart by the host they connect from: the address in a
+	// message is whatever the sender claims, and every message comes from a
+	// new port
+	host := remoteHost(conn)
+	if peerIsBanned(host) {
+		conn.Close()
+		return
+	}
+	request = request[magicLength:]
 	command := bytesToCommand(request[:commandLength])
 	fmt.Printf("Received %s command\n", command)
 
@@ -408,17 +619,19 @@ func handleConnection(conn net.Conn, bc *Blockchain) {
 	// case "addr":
 	// 	handleAddr(request)
 	case "block":
-		handleBlock(request, bc)
+		handleBlock(request, bc, host)
 	case "inv":
-		handleInv(request)
+		handleInv(request, bc)
 	case "getblocks":
 		handleGetBlocks(request, bc)
 	case "getdata":
 		handleGetData(request, bc)
+	case "notfound":
+		handleNotFound(request)
 	case "tx":
 		handleTx(request, bc)
 	case "version":
-		handleVersion(request, bc)
+		handleVersion(request, bc, host)
 	default:
 		fmt.Println("Unknown command!")
 	}
@@ -427,19 +640,28 @@ func handleConnection(conn net.Conn, bc *Blockchain) {
 }
 
 // StartServer starts a node
-func StartServer(nodeID, minerAddress string) {
+func StartServer(nodeID, minerAddress string, pruneDepth int) {
+	nodesLock.Lock()
 	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
+	nodesLock.Unlock()
 	miningAddress = minerAddress
-	ln, err := net.Listen(protocol, nodeAddress)
+	ln, err := net.Listen(protocol, localAddress())
 	if err != nil {
 		log.Panic(err)
 	}
 	defer ln.Close()
 
 	bc := NewBlockchain(nodeID)
+	if pruneDepth > 0 {
+		err = bc.EnablePruning(pruneDepth)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	snapshotCheck = startSnapshotValidation(bc, nodeID)
 
-	if nodeAddress != knownNodes[0] {
-		sendVersion(knownNodes[0], bc)
+	if nodes := peers(); len(nodes) > 0 && nodes[0] != localAddress() {
+		sendVersion(nodes[0], bc)
 	}
 
 	for {
@@ -463,12 +685,82 @@ func gobEncode(data interface{}) []byte {
 	return buff.Bytes()
 }
 
-func nodeIsKnown(addr string) bool {
+// markPeer raises the misbehaviour score of the peer connecting from host and
+// drops addrFrom, the address it listens on, from the known nodes once the
+// score reaches banThreshold
+func markPeer(host, addrFrom string, score int) {
+	misbehavingLock.Lock()
+	misbehaving[host] += score
+	banned := misbehaving[host] >= banThreshold
+	misbehavingLock.Unlock()
+	if !banned {
+		return
+	}
+
+	fmt.Printf("Banning peer %s\n", host)
+	if addrFrom != "" {
+		forgetNode(addrFrom)
+	}
+}
+
+func peerIsBanned(host string) bool {
+	misbehavingLock.Lock()
+	defer misbehavingLock.Unlock()
+
+	return misbehaving[host] >= banThreshold
+}
+
+// remoteHost returns the host a connection comes from
+func remoteHost(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// localAddress returns the address the node listens on
+func localAddress() string {
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+
+	return nodeAddress
+}
+
+// peers returns a copy of the known nodes
+func peers() []string {
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+
+	return append([]string{}, knownNodes...)
+}
+
+// addNode adds a node to the known nodes unless it is known already
+func addNode(addr string) {
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+
 	for _, node := range knownNodes {
 		if node == addr {
-			return true
+			return
 		}
 	}
+	knownNodes = append(knownNodes, addr)
+}
 
-	return false
+// forgetNode drops a node from the known nodes
+func forgetNode(addr string) {
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+
+	var updatedNodes []string
+	for _, node := range knownNodes {
+		if node != addr {
+			updatedNodes = append(updatedNodes, node)
+		}
+	}
+
+	knownNodes = updatedNodes
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBanMalformedBlocks(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"message that cannot be decoded", []byte("junk")},
+		{"block that cannot be decoded", gobEncode(block{"localhost:1", []byte("junk")})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "server")
+			resetPeers(t)
+
+			deliver(c.bc, append(commandToBytes("block"), tt.payload...))
+			if !peerIsBanned("pipe") {
+				t.Fatal("Sender is not banned")
+			}
+
+			// The ban holds whatever address the peer claims
+			_, miner := newTestWallet()
+			b := c.newBlock(c.tip(), miner)
+			deliver(c.bc, append(commandToBytes("block"), gobEncode(block{"localhost:2", b.Serialize()})...))
+			if c.bc.GetBestHeight() != 0 {
+				t.Error("Block of a banned peer is added")
+			}
+		})
+	}
+}
+
+func TestDropForeignAndOversizedMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		magic   [magicLength]byte
+		padding int // bytes appended to the block message
+		added   bool
+	}{
+		{"message of the network", activeNetParams.Magic, 0, true},
+		{"padded message of the network", activeNetParams.Magic, 1024, true},
+		{"message of another network", [magicLength]byte{1, 2, 3, 4}, 0, false},
+		{"oversized message", activeNetParams.Magic, maxMessageSize, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "server")
+			resetPeers(t)
+			_, miner := newTestWallet()
+			b := c.newBlock(c.tip(), miner)
+
+			message := append(tt.magic[:], commandToBytes("block")...)
+			message = append(message, gobEncode(block{"localhost:1", b.Serialize()})...)
+			deliverRaw(c.bc, append(message, make([]byte, tt.padding)...))
+
+			if added := c.bc.GetBestHeight() == 1; added != tt.added {
+				t.Errorf("Block is added: %t, want %t", added, tt.added)
+			}
+			if peerIsBanned("pipe") {
+				t.Error("Sender is banned")
+			}
+		})
+	}
+}
+
+// deliver hands message to the node as a peer connecting over a pipe, whose
+// host is "pipe", would send it
+func deliver(bc *Blockchain, message []byte) {
+	deliverRaw(bc, append(activeNetParams.Magic[:], message...))
+}
+
+// deliverRaw is deliver for data that does not start with the magic
+func deliverRaw(bc *Blockchain, data []byte) {
+	conn, peer := net.Pipe()
+	go func() {
+		peer.Write(data)
+		peer.Close()
+	}()
+
+	handleConnection(conn, bc)
+}
+
+// resetPeers clears the misbehaviour scores and the orphan pool when the test
+// ends
+func resetPeers(t *testing.T) {
+	t.Cleanup(func() {
+		misbehavingLock.Lock()
+		misbehaving = make(map[string]int)
+		misbehavingLock.Unlock()
+
+		orphansLock.Lock()
+		orphans = make(map[string][]orphanBlock)
+		orphanCount = 0
+		orphansLock.Unlock()
+	})
+}
+
+// A peer is announced the blocks it misses in batches, the next one once it
+// asks for the last block of the previous one
+func TestBlockInvBatches(t *testing.T) {
+	c := newTestChain(t, "server")
+	_, miner := newTestWallet()
+	c.mineBlocks(maxInvHashes+2, miner)
+	peer := listen(t)
+
+	deliver(c.bc, append(commandToBytes("getblocks"), gobEncode(getblocks{peer.addr, 0})...))
+	first := peer.inv(t)
+	if len(first) != maxInvHashes || !bytes.Equal(first[0], hashAt(t, c, 1)) {
+		t.Fatalf("First batch has %d hashes", len(first))
+	}
+
+	deliver(c.bc, append(commandToBytes("getdata"), gobEncode(getdata{peer.addr, "block", first[len(first)-1]})...))
+	peer.receive(t, "block")
+	if second := peer.inv(t); len(second) != 2 || !bytes.Equal(second[0], hashAt(t, c, maxInvHashes+1)) {
+		t.Fatalf("Second batch has %d hashes", len(second))
+	}
+}
+
+// testPeer collects the messages sent to a listening address
+type testPeer struct {
+	addr     string
+	messages chan []byte
+}
+
+func listen(t *testing.T) *testPeer {
+	ln, err := net.Listen(protocol, "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	peer := &testPeer{ln.Addr().String(), make(chan []byte, 16)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			message, _ := io.ReadAll(conn)
+			conn.Close()
+			peer.messages <- message[magicLength:]
+		}
+	}()
+
+	return peer
+}
+
+// receive returns the payload of the next message, which has to be command
+func (p *testPeer) receive(t *testing.T, command string) []byte {
+	t.Helper()
+
+	select {
+	case message := <-p.messages:
+		if got := bytesToCommand(message[:commandLength]); got != command {
+			t.Fatalf("Received %s, want %s", got, command)
+		}
+		return message[commandLength:]
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No %s received", command)
+		return nil
+	}
+}
+
+// inv returns the items of the next message, which has to be an inventory
+func (p *testPeer) inv(t *testing.T) [][]byte {
+	t.Helper()
+
+	var payload inv
+	if err := gob.NewDecoder(bytes.NewReader(p.receive(t, "inv"))).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+
+	return payload.Items
+}
+
+func TestOrphanBlocks(t *testing.T) {
+	c := newTestChain(t, "server")
+	resetPeers(t)
+	other := newTestChain(t, "other")
+	_, miner := newTestWallet()
+	other.mineBlocks(3, miner)
+	peer := listen(t)
+
+	sendBlock := func(height int) {
+		b := blockAt(t, other, height)
+		deliver(c.bc, append(commandToBytes("block"), gobEncode(block{peer.addr, b.Serialize()})...))
+	}
+
+	// Blocks whose parent is unknown are kept and their ancestors asked for
+	sendBlock(3)
+	sendBlock(2)
+	sendBlock(2)
+	if c.bc.GetBestHeight() != 0 || orphanCount != 2 {
+		t.Fatalf("Best height is %d with %d orphans, want 0 with 2", c.bc.GetBestHeight(), orphanCount)
+	}
+	peer.receive(t, "getblocks")
+	peer.receive(t, "getblocks")
+
+	// The parent connects the orphans waiting for it
+	sendBlock(1)
+	if !bytes.Equal(c.bc.tip, other.bc.tip) {
+		t.Fatalf("Tip is at height %d, want 3", c.bc.GetBestHeight())
+	}
+	if orphanCount != 0 || len(orphans) != 0 {
+		t.Errorf("Orphan pool keeps %d blocks", orphanCount)
+	}
+	if peerIsBanned("pipe") {
+		t.Error("Sender of the orphans is banned")
+	}
+}
+
+func TestOrphanPoolLimit(t *testing.T) {
+	resetPeers(t)
+
+	var blocks []*Block
+	for i := 0; i <= maxOrphanBlocks; i++ {
+		b := &Block{BlockHeader: BlockHeader{PrevBlockHash: heightKey(maxOrphanBlocks + 1 + i%3)}, Hash: heightKey(i)}
+		if !addOrphan(b, "localhost:1", "pipe") {
+			t.Fatalf("Orphan %d is not added", i)
+		}
+		blocks = append(blocks, b)
+	}
+	if addOrphan(blocks[maxOrphanBlocks], "localhost:1", "pipe") {
+		t.Error("Orphan is added twice")
+	}
+
+	if orphanCount != maxOrphanBlocks {
+		t.Fatalf("Orphan pool has %d blocks, want %d", orphanCount, maxOrphanBlocks)
+	}
+	kept := 0
+	for _, b := range blocks {
+		if isOrphan(b.Hash) {
+			kept++
+		}
+	}
+	if kept != maxOrphanBlocks || !isOrphan(blocks[maxOrphanBlocks].Hash) {
+		t.Errorf("Pool keeps %d of the orphans added, the latest one: %t", kept, isOrphan(blocks[maxOrphanBlocks].Hash))
+	}
+
+	taken := takeOrphans(heightKey(maxOrphanBlocks + 1))
+	if orphanCount != maxOrphanBlocks-len(taken) {
+		t.Errorf("Orphan pool has %d blocks after taking %d", orphanCount, len(taken))
+	}
+}
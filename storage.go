@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Storage is where a node keeps its blocks, the tip, the UTXO set and the
+// indexes. It is a store of named buckets of sorted keys, read and written in
+// transactions: an Update either applies all of its writes or, when fn
+// returns an error, none of them.
+type Storage interface {
+	View(fn func(tx StorageTx) error) error
+	Update(fn func(tx StorageTx) error) error
+	Close() error
+}
+
+// StorageTx is a transaction on a Storage. Slices it returns are only valid
+// until the transaction ends.
+type StorageTx interface {
+	// Bucket returns nil when there is no bucket called name
+	Bucket(name []byte) StorageBucket
+	CreateBucket(name []byte) (StorageBucket, error)
+	CreateBucketIfNotExists(name []byte) (StorageBucket, error)
+	DeleteBucket(name []byte) error
+}
+
+// StorageBucket is a set of key/value pairs sorted by key
+type StorageBucket interface {
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	Cursor() StorageCursor
+}
+
+// StorageCursor walks a bucket in key order. Every method returns a nil key
+// once it moves past either end.
+type StorageCursor interface {
+	First() (key, value []byte)
+	Last() (key, value []byte)
+	Next() (key, value []byte)
+	Prev() (key, value []byte)
+	// Seek moves to the first key not less than seek
+	Seek(seek []byte) (key, value []byte)
+}
+
+var (
+	errBucketExists    = errors.New("Bucket already exists")
+	errBucketNotFound  = errors.New("Bucket not found")
+	errReadOnlyStorage = errors.New("Storage is opened read-only")
+)
+
+// readOnlyStorage is a Storage whose Update fails, for commands that inspect
+// a blockchain without changing it
+type readOnlyStorage struct {
+	Storage
+}
+
+func (s readOnlyStorage) Update(fn func(tx StorageTx) error) error {
+	return errReadOnlyStorage
+}
+
+// storageBackend opens storages of one kind
+type storageBackend struct {
+	Name   string
+	Open   func(path string) (Storage, error)
+	Exists func(path string) bool
+	Remove func(path string) error
+	// Copy duplicates the closed storage at from as a storage at to
+	Copy func(from, to string) error
+}
+
+var storageBackends = []*storageBackend{&boltBackend, &memoryBackend}
+
+// activeStorage is the backend every blockchain is opened with
+var activeStorage = &boltBackend
+
+// SelectStorage makes the backend called name the active one
+func SelectStorage(name string) error {
+	for _, backend := range storageBackends {
+		if backend.Name == name {
+			activeStorage = backend
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Unknown storage %s", name)
+}
+
+// OpenStorage opens the storage at path with the active backend, creating it
+// if it does not exist
+func OpenStorage(path string) (Storage, error) {
+	return activeStorage.Open(path)
+}
+
+// storageExists tells whether the active backend has a storage at path
+func storageExists(path string) bool {
+	return activeStorage.Exists(path)
+}
+
+// removeStorage deletes the closed storage at path from the active backend
+func removeStorage(path string) error {
+	return activeStorage.Remove(path)
+}
+
+// copyStorage copies the closed storage at from to to, replacing any storage
+// there
+func copyStorage(from, to string) error {
+	return activeStorage.Copy(from, to)
+}
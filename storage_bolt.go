@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+)
+
+// boltBackend keeps every storage in a bolt database file
+var boltBackend = storageBackend{
+	Name: "bolt",
+	Open: func(path string) (Storage, error) {
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return nil, err
+		}
+
+		db, err := bolt.Open(path, 0600, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return boltStorage{db}, nil
+	},
+	Exists: func(path string) bool {
+		_, err := os.Stat(path)
+		return !os.IsNotExist(err)
+	},
+	Remove: os.Remove,
+	Copy: func(from, to string) error {
+		in, err := os.Open(from)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(out, in)
+		if err != nil {
+			out.Close()
+			return err
+		}
+
+		return out.Close()
+	},
+}
+
+type boltStorage struct {
+	db *bolt.DB
+}
+
+func (s boltStorage) View(fn func(tx StorageTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s boltStorage) Update(fn func(tx StorageTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s boltStorage) Close() error {
+	return s.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Bucket(name []byte) StorageBucket {
+	b := t.tx.Bucket(name)
+	if b == nil {
+		return nil
+	}
+
+	return boltBucket{b}
+}
+
+func (t boltTx) CreateBucket(name []byte) (StorageBucket, error) {
+	b, err := t.tx.CreateBucket(name)
+	if err == bolt.ErrBucketExists {
+		return nil, errBucketExists
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return boltBucket{b}, nil
+}
+
+func (t boltTx) CreateBucketIfNotExists(name []byte) (StorageBucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return boltBucket{b}, nil
+}
+
+func (t boltTx) DeleteBucket(name []byte) error {
+	err := t.tx.DeleteBucket(name)
+	if err == bolt.ErrBucketNotFound {
+		return errBucketNotFound
+	}
+
+	return err
+}
+
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+func (b boltBucket) Get(key []byte) []byte {
+	return b.b.Get(key)
+}
+
+func (b boltBucket) Put(key, value []byte) error {
+	return b.b.Put(key, value)
+}
+
+func (b boltBucket) Delete(key []byte) error {
+	return b.b.Delete(key)
+}
+
+func (b boltBucket) Cursor() StorageCursor {
+	return b.b.Cursor()
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// memoryBackend keeps every storage in memory. A storage outlives Close, so
+// it can be opened again by path, but not the process.
+var memoryBackend = storageBackend{
+	Name: "memory",
+	Open: func(path string) (Storage, error) {
+		path = memoryStoragePath(path)
+		memoryStoragesMutex.Lock()
+		defer memoryStoragesMutex.Unlock()
+
+		s, ok := memoryStorages[path]
+		if !ok {
+			s = &memoryStorage{buckets: make(map[string]*memoryBucket)}
+			memoryStorages[path] = s
+		}
+
+		return s, nil
+	},
+	Exists: func(path string) bool {
+		path = memoryStoragePath(path)
+		memoryStoragesMutex.Lock()
+		defer memoryStoragesMutex.Unlock()
+
+		_, ok := memoryStorages[path]
+		return ok
+	},
+	Remove: func(path string) error {
+		path = memoryStoragePath(path)
+		memoryStoragesMutex.Lock()
+		defer memoryStoragesMutex.Unlock()
+
+		delete(memoryStorages, path)
+		return nil
+	},
+	Copy: func(from, to string) error {
+		from, to = memoryStoragePath(from), memoryStoragePath(to)
+		memoryStoragesMutex.Lock()
+		defer memoryStoragesMutex.Unlock()
+
+		s, ok := memoryStorages[from]
+		if !ok {
+			return errors.New("Storage not found")
+		}
+
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+
+		c := &memoryStorage{buckets: make(map[string]*memoryBucket)}
+		for name, b := range s.buckets {
+			values := make(map[string][]byte, len(b.values))
+			for key, value := range b.values {
+				values[key] = append([]byte{}, value...)
+			}
+			c.buckets[name] = &memoryBucket{values, append([]string{}, b.keys...)}
+		}
+		memoryStorages[to] = c
+
+		return nil
+	},
+}
+
+var memoryStorages = make(map[string]*memoryStorage)
+var memoryStoragesMutex sync.Mutex
+
+// memoryStoragePath makes relative paths absolute, so storages opened from
+// different working directories are different storages, like files are
+func memoryStoragePath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+
+	return abs
+}
+
+var errReadOnly = errors.New("Storage transaction is read-only")
+
+type memoryStorage struct {
+	mutex   sync.RWMutex
+	buckets map[string]*memoryBucket
+}
+
+type memoryBucket struct {
+	values map[string][]byte
+	keys   []string // sorted
+}
+
+func (s *memoryStorage) View(fn func(tx StorageTx) error) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return fn(&memoryTx{s, false, nil})
+}
+
+// Update journals how to undo every write and replays the journal backwards
+// when fn fails
+func (s *memoryStorage) Update(fn func(tx StorageTx) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx := &memoryTx{s, true, nil}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.rollback()
+			panic(r)
+		}
+	}()
+
+	err := fn(tx)
+	if err != nil {
+		tx.rollback()
+	}
+
+	return err
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
+
+type memoryTx struct {
+	s        *memoryStorage
+	writable bool
+	undo     []func()
+}
+
+func (t *memoryTx) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+}
+
+func (t *memoryTx) Bucket(name []byte) StorageBucket {
+	b, ok := t.s.buckets[string(name)]
+	if !ok {
+		return nil
+	}
+
+	return &memoryTxBucket{t, b}
+}
+
+func (t *memoryTx) CreateBucket(name []byte) (StorageBucket, error) {
+	if !t.writable {
+		return nil, errReadOnly
+	}
+	if _, ok := t.s.buckets[string(name)]; ok {
+		return nil, errBucketExists
+	}
+
+	b := &memoryBucket{values: make(map[string][]byte)}
+	t.s.buckets[string(name)] = b
+	t.undo = append(t.undo, func() { delete(t.s.buckets, string(name)) })
+
+	return &memoryTxBucket{t, b}, nil
+}
+
+func (t *memoryTx) CreateBucketIfNotExists(name []byte) (StorageBucket, error) {
+	if b := t.Bucket(name); b != nil {
+		return b, nil
+	}
+
+	return t.CreateBucket(name)
+}
+
+func (t *memoryTx) DeleteBucket(name []byte) error {
+	if !t.writable {
+		return errReadOnly
+	}
+	b, ok := t.s.buckets[string(name)]
+	if !ok {
+		return errBucketNotFound
+	}
+
+	delete(t.s.buckets, string(name))
+	t.undo = append(t.undo, func() { t.s.buckets[string(name)] = b })
+
+	return nil
+}
+
+// memoryTxBucket is a bucket as seen by a transaction
+type memoryTxBucket struct {
+	tx *memoryTx
+	b  *memoryBucket
+}
+
+func (b *memoryTxBucket) Get(key []byte) []byte {
+	return b.b.values[string(key)]
+}
+
+func (b *memoryTxBucket) Put(key, value []byte) error {
+	if !b.tx.writable {
+		return errReadOnly
+	}
+
+	k := string(key)
+	old, existed := b.b.values[k]
+	b.b.put(k, append([]byte{}, value...))
+	b.tx.undo = append(b.tx.undo, func() {
+		if existed {
+			b.b.put(k, old)
+		} else {
+			b.b.delete(k)
+		}
+	})
+
+	return nil
+}
+
+func (b *memoryTxBucket) Delete(key []byte) error {
+	if !b.tx.writable {
+		return errReadOnly
+	}
+
+	k := string(key)
+	old, existed := b.b.values[k]
+	if !existed {
+		return nil
+	}
+	b.b.delete(k)
+	b.tx.undo = append(b.tx.undo, func() { b.b.put(k, old) })
+
+	return nil
+}
+
+func (b *memoryTxBucket) Cursor() StorageCursor {
+	return &memoryCursor{b: b.b, index: -1}
+}
+
+func (b *memoryBucket) put(key string, value []byte) {
+	if _, ok := b.values[key]; !ok {
+		i := sort.SearchStrings(b.keys, key)
+		b.keys = append(b.keys, "")
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = key
+	}
+	b.values[key] = value
+}
+
+func (b *memoryBucket) delete(key string) {
+	delete(b.values, key)
+	i := sort.SearchStrings(b.keys, key)
+	if i < len(b.keys) && b.keys[i] == key {
+		b.keys = append(b.keys[:i], b.keys[i+1:]...)
+	}
+}
+
+// memoryCursor remembers the key it is at rather than an index, so it keeps
+// its place when the bucket changes under it
+type memoryCursor struct {
+	b     *memoryBucket
+	key   string
+	index int
+}
+
+func (c *memoryCursor) at(i int) ([]byte, []byte) {
+	if i < 0 || i >= len(c.b.keys) {
+		c.index = -1
+		return nil, nil
+	}
+
+	c.index = i
+	c.key = c.b.keys[i]
+	return []byte(c.key), c.b.values[c.key]
+}
+
+func (c *memoryCursor) First() ([]byte, []byte) {
+	return c.at(0)
+}
+
+func (c *memoryCursor) Last() ([]byte, []byte) {
+	return c.at(len(c.b.keys) - 1)
+}
+
+func (c *memoryCursor) Next() ([]byte, []byte) {
+	if c.index < 0 {
+		return nil, nil
+	}
+
+	i := sort.SearchStrings(c.b.keys, c.key)
+	if i < len(c.b.keys) && c.b.keys[i] == c.key {
+		i++
+	}
+	return c.at(i)
+}
+
+func (c *memoryCursor) Prev() ([]byte, []byte) {
+	if c.index < 0 {
+		return nil, nil
+	}
+
+	return c.at(sort.SearchStrings(c.b.keys, c.key) - 1)
+}
+
+func (c *memoryCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.at(sort.SearchStrings(c.b.keys, string(seek)))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// The backends keep the same promises, so every test runs on each of them
+
+func TestStorageCursor(t *testing.T) {
+	for _, backend := range storageBackends {
+		t.Run(backend.Name, func(t *testing.T) {
+			db := openTestStorage(t, backend)
+			update(t, db, func(tx StorageTx) error {
+				b, err := tx.CreateBucket([]byte("b"))
+				if err != nil {
+					return err
+				}
+				for _, key := range []string{"c", "a", "d", "b"} {
+					b.Put([]byte(key), []byte("value "+key))
+				}
+				return b.Delete([]byte("d"))
+			})
+
+			db.View(func(tx StorageTx) error {
+				c := tx.Bucket([]byte("b")).Cursor()
+				tests := []struct {
+					name string
+					move func() ([]byte, []byte)
+					want string
+				}{
+					{"First", c.First, "a"},
+					{"Next", c.Next, "b"},
+					{"Next", c.Next, "c"},
+					{"Next past the end", c.Next, ""},
+					{"Last", c.Last, "c"},
+					{"Prev", c.Prev, "b"},
+					{"Seek to a key", func() ([]byte, []byte) { return c.Seek([]byte("b")) }, "b"},
+					{"Seek between keys", func() ([]byte, []byte) { return c.Seek([]byte("bb")) }, "c"},
+					{"Seek past the end", func() ([]byte, []byte) { return c.Seek([]byte("z")) }, ""},
+				}
+				for _, tt := range tests {
+					key, value := tt.move()
+					if string(key) != tt.want || tt.want != "" && string(value) != "value "+tt.want {
+						t.Errorf("%s: got %q = %q, want %q", tt.name, key, value, tt.want)
+					}
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestStorageUpdateRollsBack(t *testing.T) {
+	tests := []struct {
+		name string
+		fail func() error
+	}{
+		{"error", func() error { return errors.New("Failed") }},
+		{"panic", func() error { panic("failed") }},
+	}
+
+	for _, backend := range storageBackends {
+		for _, tt := range tests {
+			t.Run(backend.Name+" "+tt.name, func(t *testing.T) {
+				db := openTestStorage(t, backend)
+				update(t, db, func(tx StorageTx) error {
+					b, _ := tx.CreateBucket([]byte("kept"))
+					b.Put([]byte("changed"), []byte("old"))
+					return b.Put([]byte("deleted"), []byte("old"))
+				})
+
+				func() {
+					defer func() { recover() }()
+					db.Update(func(tx StorageTx) error {
+						b := tx.Bucket([]byte("kept"))
+						b.Put([]byte("changed"), []byte("new"))
+						b.Put([]byte("added"), []byte("new"))
+						b.Delete([]byte("deleted"))
+						tx.CreateBucket([]byte("created"))
+						return tt.fail()
+					})
+				}()
+
+				db.View(func(tx StorageTx) error {
+					b := tx.Bucket([]byte("kept"))
+					if got := b.Get([]byte("changed")); string(got) != "old" {
+						t.Errorf("changed key is %q", got)
+					}
+					if got := b.Get([]byte("deleted")); string(got) != "old" {
+						t.Errorf("deleted key is %q", got)
+					}
+					if got := b.Get([]byte("added")); got != nil {
+						t.Errorf("added key is %q", got)
+					}
+					if tx.Bucket([]byte("created")) != nil {
+						t.Error("created bucket is kept")
+					}
+					return nil
+				})
+			})
+		}
+	}
+}
+
+func TestStorageViewIsReadOnly(t *testing.T) {
+	for _, backend := range storageBackends {
+		t.Run(backend.Name, func(t *testing.T) {
+			db := openTestStorage(t, backend)
+			update(t, db, func(tx StorageTx) error {
+				_, err := tx.CreateBucket([]byte("b"))
+				return err
+			})
+
+			db.View(func(tx StorageTx) error {
+				if tx.Bucket([]byte("b")).Put([]byte("k"), []byte("v")) == nil {
+					t.Error("Put in a View succeeded")
+				}
+				if _, err := tx.CreateBucket([]byte("c")); err == nil {
+					t.Error("CreateBucket in a View succeeded")
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestStorageCopyAndRemove(t *testing.T) {
+	for _, backend := range storageBackends {
+		t.Run(backend.Name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db")
+			db, err := backend.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			update(t, db, func(tx StorageTx) error {
+				b, _ := tx.CreateBucket([]byte("b"))
+				return b.Put([]byte("k"), []byte("v"))
+			})
+			db.Close()
+
+			copied := path + ".copy"
+			if err := backend.Copy(path, copied); err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+			if backend.Exists(path) || !backend.Exists(copied) {
+				t.Fatal("Remove or Copy left the wrong storages")
+			}
+
+			db, err = backend.Open(copied)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer backend.Remove(copied)
+			defer db.Close()
+			db.View(func(tx StorageTx) error {
+				if got := tx.Bucket([]byte("b")).Get([]byte("k")); !bytes.Equal(got, []byte("v")) {
+					t.Errorf("copied value is %q", got)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func openTestStorage(t *testing.T, backend *storageBackend) Storage {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := backend.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		backend.Remove(path)
+	})
+
+	return db
+}
+
+func update(t *testing.T, db Storage, fn func(tx StorageTx) error) {
+	t.Helper()
+
+	if err := db.Update(fn); err != nil {
+		t.Fatal(err)
+	}
+}
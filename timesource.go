@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxTimeAdjustment bounds how far peers can move our clock, in seconds
+const maxTimeAdjustment = 70 * 60
+
+// Offsets between the clocks of peers and ours, keyed by peer address
+var timeOffsets = make(map[string]int64)
+var timeOffsetsLock sync.Mutex
+
+// addTimeSample records the time a peer reported in its version message
+func addTimeSample(addr string, peerTime int64) {
+	timeOffsetsLock.Lock()
+	defer timeOffsetsLock.Unlock()
+
+	timeOffsets[addr] = peerTime - time.Now().Unix()
+}
+
+// adjustedTime returns the network-adjusted time: our clock moved by the
+// median offset reported by peers
+func adjustedTime() int64 {
+	timeOffsetsLock.Lock()
+	defer timeOffsetsLock.Unlock()
+
+	var offsets []int64
+	for _, offset := range timeOffsets {
+		offsets = append(offsets, offset)
+	}
+
+	offset := medianTime(offsets)
+	if offset > maxTimeAdjustment || offset < -maxTimeAdjustment {
+		offset = 0
+	}
+
+	return time.Now().Unix() + offset
+}
+
+// medianTime returns the median of the given timestamps or 0 if there are none
+func medianTime(timestamps []int64) int64 {
+	if len(timestamps) == 0 {
+		return 0
+	}
+
+	sorted := append([]int64{}, timestamps...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return sorted[len(sorted)/2]
+}
@@ -9,14 +9,13 @@ import (
 	"math/big"
 	"strings"
 
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
 	"log"
 )
 
-const subsidy = 10
-
 // Transaction represents a Bitcoin transaction
 type Transaction struct {
 	ID   []byte
@@ -49,11 +48,40 @@ func (tx *Transaction) Hash() []byte {
 	txCopy := *tx
 	txCopy.ID = []byte{}
 
-	hash = sha256.Sum256(txCopy.Serialize())
+	hash = sha256.Sum256(txCopy.hashData())
 
 	return hash[:]
 }
 
+// hashData encodes the transaction in a fixed layout for its hash and the
+// Merkle root of its block. Serialize cannot be used: gob writes the type
+// numbers a process happened to assign, so its output differs by process.
+func (tx Transaction) hashData() []byte {
+	data := appendBytes(nil, tx.ID)
+
+	data = binary.BigEndian.AppendUint32(data, uint32(len(tx.Vin)))
+	for _, vin := range tx.Vin {
+		data = appendBytes(data, vin.Txid)
+		data = binary.BigEndian.AppendUint64(data, uint64(vin.Vout))
+		data = appendBytes(data, vin.Signature)
+		data = appendBytes(data, vin.PubKey)
+	}
+
+	data = binary.BigEndian.AppendUint32(data, uint32(len(tx.Vout)))
+	for _, vout := range tx.Vout {
+		data = binary.BigEndian.AppendUint64(data, uint64(vout.Value))
+		data = appendBytes(data, vout.PubKeyHash)
+	}
+
+	return data
+}
+
+// appendBytes appends b to data after its length
+func appendBytes(data, b []byte) []byte {
+	data = binary.BigEndian.AppendUint32(data, uint32(len(b)))
+	return append(data, b...)
+}
+
 // Sign signs each input of a Transaction
 func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
 	if tx.IsCoinbase() {
@@ -79,7 +107,10 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 		if err != nil {
 			log.Panic(err)
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
+		// r and s fill half of the signature each, which is how Verify
+		// splits it
+		size := (privKey.Curve.Params().BitSize + 7) / 8
+		signature := append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
 
 		tx.Vin[inID].Signature = signature
 		txCopy.Vin[inID].PubKey = nil
@@ -172,8 +203,34 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	return true
 }
 
-// NewCoinbaseTX creates a new coinbase transaction
-func NewCoinbaseTX(to, data string) *Transaction {
+// GetBlockSubsidy returns the reward for mining the block at height
+func GetBlockSubsidy(height int) int {
+	params := activeNetParams
+	reward := params.Subsidy
+
+	for era := 0; era < height/params.HalvingInterval && reward > 0; era++ {
+		reward /= 2
+	}
+
+	return reward
+}
+
+// MaxSupply returns how many coins the chain ever creates: the allocations of
+// the genesis block and the subsidies of the halving schedule
+func MaxSupply() int {
+	params := activeNetParams
+	supply := expectedEmission(0)
+
+	for reward := params.Subsidy; reward > 0; reward /= 2 {
+		supply += reward * params.HalvingInterval
+	}
+
+	// The genesis block takes the place of the first block of the schedule
+	return supply - params.Subsidy
+}
+
+// NewCoinbaseTX creates a new coinbase transaction paying value to the miner
+func NewCoinbaseTX(to, data string, value int) *Transaction {
 	if data == "" {
 		randData := make([]byte, 20)
 		_, err := rand.Read(randData)
@@ -185,22 +242,22 @@ func NewCoinbaseTX(to, data string) *Transaction {
 	}
 
 	txin := TXInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTXOutput(subsidy, to)
+	txout := NewTXOutput(value, to)
 	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}}
 	tx.ID = tx.Hash()
 
 	return &tx
 }
 
-// NewUTXOTransaction creates a new transaction
-func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet) *Transaction {
+// NewUTXOTransaction creates a new transaction leaving fee to the miner
+func NewUTXOTransaction(wallet *Wallet, to string, amount, fee int, UTXOSet *UTXOSet) *Transaction {
 	var inputs []TXInput
 	var outputs []TXOutput
 
 	pubKeyHash := HashPubKey(wallet.PublicKey)
-	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount)
+	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount+fee)
 
-	if acc < amount {
+	if acc < amount+fee {
 		log.Panic("ERROR: Not enough funds")
 	}
 
@@ -220,8 +277,8 @@ func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet)
 	// Build a list of outputs
 	from := string(wallet.GetAddress())
 	outputs = append(outputs, *NewTXOutput(amount, to))
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from)) // a change
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTXOutput(acc-amount-fee, from)) // a change
 	}
 
 	tx := Transaction{nil, inputs, outputs}
@@ -231,6 +288,23 @@ func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet)
 	return &tx
 }
 
+// NewUTXOTransactionAtFeeRate creates a new transaction paying feeRate coins
+// per 1000 bytes. The fee is raised until it covers the signed transaction,
+// which may grow when more inputs are needed.
+func NewUTXOTransactionAtFeeRate(wallet *Wallet, to string, amount, feeRate int, UTXOSet *UTXOSet) *Transaction {
+	fee := 0
+
+	for {
+		tx := NewUTXOTransaction(wallet, to, amount, fee, UTXOSet)
+
+		required := (feeRate*len(tx.Serialize()) + 999) / 1000
+		if fee >= required {
+			return tx
+		}
+		fee = required
+	}
+}
+
 // DeserializeTransaction deserializes a transaction
 func DeserializeTransaction(data []byte) Transaction {
 	var transaction Transaction
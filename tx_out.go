@@ -33,17 +33,26 @@ func NewTXOutput(value int, address string) *TXOutput {
 	return txo
 }
 
-// TXOutputs collects TXOutput
-type TXOutputs struct {
-	Outputs []TXOutput
+// UTXOEntry is an unspent output, along with the height of the block that
+// created it and whether it was a coinbase
+type UTXOEntry struct {
+	Output   TXOutput
+	Height   int
+	Coinbase bool
 }
 
-// Serialize serializes TXOutputs
-func (outs TXOutputs) Serialize() []byte {
+// IsMature checks whether the output can be spent in a block at spendHeight.
+// Only coinbase outputs have to wait, except for the premine in the genesis block.
+func (entry UTXOEntry) IsMature(spendHeight int) bool {
+	return !entry.Coinbase || entry.Height == 0 || spendHeight-entry.Height >= activeNetParams.CoinbaseMaturity
+}
+
+// Serialize serializes UTXOEntry
+func (entry UTXOEntry) Serialize() []byte {
 	var buff bytes.Buffer
 
 	enc := gob.NewEncoder(&buff)
-	err := enc.Encode(outs)
+	err := enc.Encode(entry)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -51,15 +60,15 @@ func (outs TXOutputs) Serialize() []byte {
 	return buff.Bytes()
 }
 
-// DeserializeOutputs deserializes TXOutputs
-func DeserializeOutputs(data []byte) TXOutputs {
-	var outputs TXOutputs
+// DeserializeUTXOEntry deserializes UTXOEntry
+func DeserializeUTXOEntry(data []byte) UTXOEntry {
+	var entry UTXOEntry
 
 	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&outputs)
+	err := dec.Decode(&entry)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	return outputs
+	return entry
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestBlockSubsidy(t *testing.T) {
+	tests := []struct {
+		name     string
+		subsidy  int
+		interval int
+		rewards  map[int]int // by height
+	}{
+		{"halves every interval", 10, 4, map[int]int{1: 10, 3: 10, 4: 5, 7: 5, 8: 2, 12: 1, 15: 1, 16: 0, 100: 0}},
+		{"odd subsidy rounds down", 25, 2, map[int]int{1: 25, 2: 12, 4: 6, 6: 3, 8: 1, 10: 0}},
+		{"single block eras", 8, 1, map[int]int{1: 4, 2: 2, 3: 1, 4: 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setParams(t, func(params *ChainParams) {
+				params.Subsidy = tt.subsidy
+				params.HalvingInterval = tt.interval
+			})
+
+			for height, want := range tt.rewards {
+				if got := GetBlockSubsidy(height); got != want {
+					t.Errorf("Subsidy at height %d is %d, want %d", height, got, want)
+				}
+			}
+
+			// The supply is what the blocks up to the last one with a
+			// reward create
+			supply := expectedEmission(0)
+			for height := 1; GetBlockSubsidy(height) > 0; height++ {
+				supply += GetBlockSubsidy(height)
+			}
+			if got := MaxSupply(); got != supply {
+				t.Errorf("Max supply is %d, the blocks create %d", got, supply)
+			}
+		})
+	}
+}
+
+func TestCoinbaseMaturity(t *testing.T) {
+	tests := []struct {
+		maturity int
+		depth    int // blocks on top of the coinbase before it is spent
+		mature   bool
+	}{
+		{1, 0, true},
+		{2, 0, false},
+		{2, 1, true},
+		{5, 3, false},
+		{5, 4, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("maturity %d depth %d", tt.maturity, tt.depth), func(t *testing.T) {
+			setParams(t, func(params *ChainParams) { params.CoinbaseMaturity = tt.maturity })
+			c := newTestChain(t, "maturity")
+			x, xAddress := newTestWallet()
+			_, yAddress := newTestWallet()
+
+			coinbase := c.mine(xAddress).Transactions[0]
+			c.mineBlocks(tt.depth, yAddress)
+
+			spendable, _ := c.utxo().FindSpendableOutputs(addressPubKeyHash(xAddress), 1)
+			if (spendable > 0) != tt.mature {
+				t.Errorf("%d coins spendable", spendable)
+			}
+
+			// A block spending the coinbase anyway is only valid once it matured
+			spend := &Transaction{nil, []TXInput{{coinbase.ID, 0, nil, x.PublicKey}}, []TXOutput{*NewTXOutput(coinbase.Vout[0].Value, yAddress)}}
+			spend.ID = spend.Hash()
+			c.bc.SignTransaction(spend, x.PrivateKey)
+
+			err := c.bc.ValidateBlock(c.newBlock(c.tip(), yAddress, spend))
+			if tt.mature && err != nil || !tt.mature && (err == nil || !strings.Contains(err.Error(), "immature")) {
+				t.Errorf("Block spending the coinbase: %v", err)
+			}
+		})
+	}
+}
+
+func TestFees(t *testing.T) {
+	tests := []struct {
+		name    string
+		fee     int
+		feeRate int // coins per 1000 bytes, used when fee is 0
+		claim   int // coinbase claim over subsidy and fees
+		valid   bool
+	}{
+		{"no fee", 0, 0, 0, true},
+		{"fee claimed", 2, 0, 0, true},
+		{"fee left unclaimed", 2, 0, -2, true},
+		{"fee overclaimed", 2, 0, 1, false},
+		{"fee rate claimed", 0, 3, 0, true},
+		{"fee rate overclaimed", 0, 3, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "fees")
+			_, xAddress := newTestWallet()
+
+			var tx *Transaction
+			if tt.feeRate > 0 {
+				tx = NewUTXOTransactionAtFeeRate(testWallet, xAddress, 5, tt.feeRate, c.utxo())
+			} else {
+				tx = c.send(testWallet, xAddress, 5, tt.fee)
+			}
+
+			fee, err := c.bc.CalculateFee(tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.fee
+			if tt.feeRate > 0 {
+				want = (tt.feeRate*len(tx.Serialize()) + 999) / 1000
+			}
+			if fee != want {
+				t.Fatalf("Fee is %d, want %d", fee, want)
+			}
+
+			tip := c.tip()
+			c.time++
+			coinbase := NewCoinbaseTX(xAddress, "", GetBlockSubsidy(tip.Height+1)+fee+tt.claim)
+			block := NewBlock([]*Transaction{coinbase, tx}, tip.Hash, tip.Height+1, c.bc.CalcNextBits(tip), c.time)
+
+			err = c.bc.ValidateBlock(block)
+			if tt.valid && err != nil || !tt.valid && (err == nil || !strings.Contains(err.Error(), "Coinbase claims")) {
+				t.Fatalf("Block: %v", err)
+			}
+			if tt.valid {
+				c.add(block)
+				if got := c.balance(xAddress); got != 5+GetBlockSubsidy(tip.Height+1)+fee+tt.claim {
+					t.Errorf("Balance is %d", got)
+				}
+			}
+		})
+	}
+}
+
+// Outputs that would inflate a fee leave the transaction without one
+func TestFeeOfUntrustedOutputs(t *testing.T) {
+	tests := []struct {
+		name    string
+		outputs []int
+		err     string
+	}{
+		{"negative output", []int{12, -5}, "negative output"},
+		{"outputs overflowing", []int{math.MaxInt, 2}, "adding up to more than"},
+		{"more than the inputs", []int{11}, "spends 11 but only has 10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "fees")
+			_, xAddress := newTestWallet()
+			tx := c.send(testWallet, xAddress, 5, 0)
+			tx.Vout = nil
+			for _, value := range tt.outputs {
+				tx.Vout = append(tx.Vout, *NewTXOutput(value, xAddress))
+			}
+			resign(c, tx, testWallet)
+
+			if fee, err := c.bc.CalculateFee(tx); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Fee: %d, %v, want %q", fee, err, tt.err)
+			}
+			if len(c.bc.SelectTransactions([]*Transaction{tx})) > 0 {
+				t.Error("Transaction selected for a block")
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+)
+
+// The transaction index is optional: it is only kept up to date once it has
+// been built with ReindexTransactions
+const txIndexBucket = "txindex"
+
+// TxLocation tells which block of the main chain holds a transaction and at
+// which position
+type TxLocation struct {
+	BlockHash []byte
+	Position  int
+}
+
+// Serialize serializes TxLocation
+func (loc TxLocation) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(loc)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// DeserializeTxLocation deserializes TxLocation
+func DeserializeTxLocation(data []byte) TxLocation {
+	var loc TxLocation
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&loc)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return loc
+}
+
+// ReindexTransactions builds the transaction index from the main chain,
+// replacing the one there is. It returns the number of indexed transactions.
+func (bc *Blockchain) ReindexTransactions() int {
+	bucketName := []byte(txIndexBucket)
+	count := 0
+
+	err := bc.DB.Update(func(tx StorageTx) error {
+		err := tx.DeleteBucket(bucketName)
+		if err != nil && err != errBucketNotFound {
+			log.Panic(err)
+		}
+
+		_, err = tx.CreateBucket(bucketName)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		b := tx.Bucket([]byte(blocksBucket))
+		hash := bc.tip
+		for {
+			block := DeserializeBlock(b.Get(hash))
+			hash = block.PrevBlockHash
+
+			indexTransactions(tx, block)
+			count += len(block.Transactions)
+
+			if len(block.PrevBlockHash) == 0 {
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return count
+}
+
+// findIndexedTransaction looks a transaction up in the transaction index.
+// indexed is false when there is no index to look in.
+func (bc *Blockchain) findIndexedTransaction(ID []byte) (transaction *Transaction, indexed bool) {
+	err := bc.DB.View(func(tx StorageTx) error {
+		ib := tx.Bucket([]byte(txIndexBucket))
+		if ib == nil {
+			return nil
+		}
+		indexed = true
+
+		locData := ib.Get(ID)
+		if locData == nil {
+			return nil
+		}
+		loc := DeserializeTxLocation(locData)
+
+		blockData := tx.Bucket([]byte(blocksBucket)).Get(loc.BlockHash)
+		if blockData == nil {
+			return nil
+		}
+		block := DeserializeBlock(blockData)
+
+		if loc.Position < len(block.Transactions) && bytes.Equal(block.Transactions[loc.Position].ID, ID) {
+			transaction = block.Transactions[loc.Position]
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return transaction, indexed
+}
+
+// indexTransactions adds the transactions of a block joining the main chain
+// to the transaction index, if there is one
+func indexTransactions(tx StorageTx, block *Block) {
+	ib := tx.Bucket([]byte(txIndexBucket))
+	if ib == nil {
+		return
+	}
+
+	for i, transaction := range block.Transactions {
+		err := ib.Put(transaction.ID, TxLocation{block.Hash, i}.Serialize())
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+}
+
+// unindexTransactions removes the transactions of a block leaving the main
+// chain from the transaction index, if there is one
+func unindexTransactions(tx StorageTx, block *Block) {
+	ib := tx.Bucket([]byte(txIndexBucket))
+	if ib == nil {
+		return
+	}
+
+	for _, transaction := range block.Transactions {
+		err := ib.Delete(transaction.ID)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+}
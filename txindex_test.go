@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTransactionIndex(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *testChain, spend *Transaction, miner string)
+		height int // of the block holding the spend, -1 for none on the main chain
+	}{
+		{"connected blocks", nil, 1},
+		{"disconnected spend", func(c *testChain, spend *Transaction, miner string) {
+			c.bc.disconnectTip()
+			c.bc.disconnectTip()
+		}, -1},
+		{"reorganized away", func(c *testChain, spend *Transaction, miner string) {
+			block := GetGenesisBlock()
+			for i := 0; i < 3; i++ {
+				block = c.newBlock(block, miner)
+				c.add(block)
+			}
+		}, -1},
+		{"reorganized to a higher block", func(c *testChain, spend *Transaction, miner string) {
+			block := c.newBlock(GetGenesisBlock(), miner)
+			c.add(block)
+			block = c.newBlock(block, miner, spend)
+			c.add(block)
+			c.add(c.newBlock(block, miner))
+		}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "txindex")
+			if count := c.bc.ReindexTransactions(); count != 1 {
+				t.Fatalf("Indexed %d transactions of the genesis block", count)
+			}
+			_, miner := newTestWallet()
+			_, payee := newTestWallet()
+			spend := c.send(testWallet, payee, 3, 0)
+			coinbase := c.mine(miner, spend).Transactions[0]
+			c.mine(miner)
+			if tt.change != nil {
+				tt.change(c, spend, miner)
+			}
+
+			found, indexed := c.bc.findIndexedTransaction(spend.ID)
+			if !indexed {
+				t.Fatal("Transaction index is gone")
+			}
+			if tt.height < 0 {
+				if found != nil {
+					t.Error("Transaction off the main chain is indexed")
+				}
+				if found, _ := c.bc.findIndexedTransaction(coinbase.ID); found != nil {
+					t.Error("Coinbase off the main chain is indexed")
+				}
+				return
+			}
+			if found == nil || !bytes.Equal(found.ID, spend.ID) {
+				t.Fatal("Transaction is not indexed")
+			}
+
+			var loc TxLocation
+			c.bc.DB.View(func(tx StorageTx) error {
+				loc = DeserializeTxLocation(tx.Bucket([]byte(txIndexBucket)).Get(spend.ID))
+				return nil
+			})
+			if block := blockAt(t, c, tt.height); !bytes.Equal(loc.BlockHash, block.Hash) || loc.Position != 1 {
+				t.Errorf("Transaction is indexed at %x position %d, want block %x position 1", loc.BlockHash, loc.Position, block.Hash)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+)
+
+// SpentOutput is an output removed from the UTXO set when a block was
+// connected, with what is needed to recreate its chainstate entry
+type SpentOutput struct {
+	Txid     []byte
+	Position int // index of the output in its transaction
+	Output   TXOutput
+	Height   int
+	Coinbase bool
+}
+
+// BlockUndo holds what is needed to disconnect a block again: the outputs
+// it spent, in the order they were removed from the UTXO set
+type BlockUndo struct {
+	SpentOutputs []SpentOutput
+}
+
+// Serialize serializes BlockUndo
+func (undo BlockUndo) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(undo)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// DeserializeUndo deserializes BlockUndo
+func DeserializeUndo(data []byte) BlockUndo {
+	var undo BlockUndo
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&undo)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return undo
+}
+
+// readUndo returns the undo record of the block with the hash, failing when it
+// is missing or cannot be decoded
+func readUndo(tx StorageTx, hash []byte) (BlockUndo, error) {
+	var undo BlockUndo
+
+	var data []byte
+	if ub := tx.Bucket([]byte(undoBucket)); ub != nil {
+		data = ub.Get(hash)
+	}
+	if data == nil {
+		return undo, fmt.Errorf("Undo record of block %x is missing", hash)
+	}
+
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&undo)
+	if err != nil {
+		return undo, fmt.Errorf("Undo record of block %x is corrupt: %s", hash, err)
+	}
+
+	return undo, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDisconnectRestoresSpentOutputs(t *testing.T) {
+	x, xAddress := newTestWallet()
+	_, yAddress := newTestWallet()
+
+	tests := []struct {
+		name  string
+		build func(t *testing.T, c *testChain)
+	}{
+		{"spend the genesis allocation", func(t *testing.T, c *testChain) {
+			c.mine(yAddress, c.send(testWallet, xAddress, 7, 1))
+		}},
+		{"spend an output of the block before", func(t *testing.T, c *testChain) {
+			c.mine(yAddress, c.send(testWallet, xAddress, 7, 0))
+			c.mine(yAddress, c.send(x, yAddress, 5, 0))
+		}},
+		{"spend outputs of two transactions at once", func(t *testing.T, c *testChain) {
+			c.mine(yAddress, c.send(testWallet, xAddress, 4, 0))
+			c.mine(yAddress, c.send(testWallet, xAddress, 3, 0))
+			c.mine(yAddress, c.send(x, yAddress, 6, 0))
+		}},
+		{"spend matured coinbases", func(t *testing.T, c *testChain) {
+			setParams(t, func(params *ChainParams) { params.CoinbaseMaturity = 2 })
+			c.mineBlocks(4, xAddress)
+			c.mine(yAddress, c.send(x, yAddress, 15, 0))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "undo")
+			tt.build(t, c)
+
+			// Replaying the chain on another node gives the UTXO set after
+			// every block
+			replay := newTestChain(t, "undo-replay")
+			hashes := make(map[int][]byte)
+			_, hashes[0] = replay.bc.UTXOSnapshot()
+			for height := 1; height <= c.tip().Height; height++ {
+				block, _ := c.bc.GetBlockByHeight(height)
+				replay.add(&block)
+				_, hashes[height] = replay.bc.UTXOSnapshot()
+			}
+
+			for c.tip().Height > 0 {
+				tip := c.tip()
+				c.bc.disconnectTip()
+
+				_, hash := c.bc.UTXOSnapshot()
+				if !bytes.Equal(hash, hashes[tip.Height-1]) {
+					t.Fatalf("UTXO set after disconnecting height %d differs from the one connecting height %d left", tip.Height, tip.Height-1)
+				}
+				c.bc.DB.View(func(tx StorageTx) error {
+					if tx.Bucket([]byte(undoBucket)).Get(tip.Hash) != nil {
+						t.Errorf("Undo record of height %d is kept", tip.Height)
+					}
+					return nil
+				})
+			}
+		})
+	}
+}
@@ -1,39 +1,68 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 	"log"
-
-	"github.com/boltdb/bolt"
 )
 
 const utxoBucket = "chainstate"
+const undoBucket = "undo"
+
+// reindexBatchSize is how many blocks are applied to the UTXO set in one
+// transaction while it is rebuilt
+const reindexBatchSize = 500
+
+// The chainstate bucket also records the block the UTXO set matches under
+// bestBlockKey, which is shorter than any transaction ID
+var bestBlockKey = []byte("best")
 
-// UTXOSet represents UTXO set
+// UTXOSet represents UTXO set. Every unspent output is stored as a UTXOEntry
+// under its outpoint key.
 type UTXOSet struct {
 	Blockchain *Blockchain
 }
 
-// FindSpendableOutputs finds and returns unspent outputs to reference in inputs
+// outpointKey returns the chainstate key of output vout of transaction txID:
+// the transaction ID and the 4-byte big-endian output index, so the outputs
+// of a transaction sort together and in order
+func outpointKey(txID []byte, vout int) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte{}, txID...), uint32(vout))
+}
+
+// splitOutpointKey returns the transaction ID and output index of an outpoint key
+func splitOutpointKey(key []byte) ([]byte, int) {
+	split := len(key) - 4
+	return key[:split], int(binary.BigEndian.Uint32(key[split:]))
+}
+
+// FindSpendableOutputs finds and returns unspent outputs to reference in inputs.
+// Coinbase outputs that have not matured yet are left out.
 func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[string][]int) {
 	unspentOutputs := make(map[string][]int)
 	accumulated := 0
 	db := u.Blockchain.DB
+	spendHeight := u.Blockchain.GetBestHeight() + 1
 
-	err := db.View(func(tx *bolt.Tx) error {
+	err := db.View(func(tx StorageTx) error {
 		b := tx.Bucket([]byte(utxoBucket))
 		c := b.Cursor()
 
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			txID := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
+		for k, v := c.First(); k != nil && accumulated < amount; k, v = c.Next() {
+			if bytes.Equal(k, bestBlockKey) {
+				continue
+			}
 
-			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubkeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
-				}
+			entry := DeserializeUTXOEntry(v)
+			if !entry.IsMature(spendHeight) || !entry.Output.IsLockedWithKey(pubkeyHash) {
+				continue
 			}
+
+			txID, vout := splitOutpointKey(k)
+			accumulated += entry.Output.Value
+			unspentOutputs[hex.EncodeToString(txID)] = append(unspentOutputs[hex.EncodeToString(txID)], vout)
 		}
 
 		return nil
@@ -50,17 +79,18 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	var UTXOs []TXOutput
 	db := u.Blockchain.DB
 
-	err := db.View(func(tx *bolt.Tx) error {
+	err := db.View(func(tx StorageTx) error {
 		b := tx.Bucket([]byte(utxoBucket))
 		c := b.Cursor()
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			outs := DeserializeOutputs(v)
+			if bytes.Equal(k, bestBlockKey) {
+				continue
+			}
 
-			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
+			entry := DeserializeUTXOEntry(v)
+			if entry.Output.IsLockedWithKey(pubKeyHash) {
+				UTXOs = append(UTXOs, entry.Output)
 			}
 		}
 
@@ -73,17 +103,52 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	return UTXOs
 }
 
+// FindOutput returns output vout of transaction txID if it is still unspent
+func (u UTXOSet) FindOutput(txID []byte, vout int) (UTXOEntry, bool) {
+	var entry UTXOEntry
+	found := false
+	db := u.Blockchain.DB
+
+	if vout < 0 {
+		return entry, false
+	}
+
+	err := db.View(func(tx StorageTx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		if data := b.Get(outpointKey(txID, vout)); data != nil {
+			entry = DeserializeUTXOEntry(data)
+			found = true
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return entry, found
+}
+
 // CountTransactions returns the number of transactions in the UTXO set
 func (u UTXOSet) CountTransactions() int {
 	db := u.Blockchain.DB
 	counter := 0
 
-	err := db.View(func(tx *bolt.Tx) error {
+	err := db.View(func(tx StorageTx) error {
 		b := tx.Bucket([]byte(utxoBucket))
 		c := b.Cursor()
+		var lastTxID []byte
 
 		for k, _ := c.First(); k != nil; k, _ = c.Next() {
-			counter++
+			if bytes.Equal(k, bestBlockKey) {
+				continue
+			}
+
+			txID, _ := splitOutpointKey(k)
+			if !bytes.Equal(txID, lastTxID) {
+				counter++
+				lastTxID = append(lastTxID[:0], txID...)
+			}
 		}
 
 		return nil
@@ -95,96 +160,315 @@ func (u UTXOSet) CountTransactions() int {
 	return counter
 }
 
-// Reindex rebuilds the UTXO set
-func (u UTXOSet) Reindex() {
+// UTXOStats summarizes the UTXO set of the block BestBlock: how many
+// transactions and outputs it holds, how many coins they are worth against
+// how many the blocks up to Height may have created, how many bytes it takes
+// to store and its hash
+type UTXOStats struct {
+	BestBlock    []byte
+	Height       int
+	Transactions int
+	Outputs      int
+	Supply       int
+	Emission     int
+	Size         int
+	Hash         []byte
+}
+
+// Stats returns the statistics of the UTXO set
+func (u UTXOSet) Stats() UTXOStats {
+	stats := UTXOStats{}
+	var entries []SnapshotEntry
+
+	err := u.Blockchain.DB.View(func(tx StorageTx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		stats.BestBlock = append([]byte{}, b.Get(bestBlockKey)...)
+		stats.Height = DeserializeBlock(tx.Bucket([]byte(blocksBucket)).Get(stats.BestBlock)).Height
+
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			stats.Size += len(k) + len(v)
+		}
+		entries = snapshotEntries(tx)
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	stats.Transactions = len(entries)
+	for _, entry := range entries {
+		stats.Outputs += len(entry.Outputs)
+		for _, out := range entry.Outputs {
+			stats.Supply += out.Output.Value
+		}
+	}
+	stats.Emission = expectedEmission(stats.Height)
+	stats.Hash = utxoSetHash(entries)
+
+	return stats
+}
+
+// expectedEmission returns how many coins the main chain up to height may
+// have created: the allocations of the genesis block and the subsidy of every
+// block after it. Coinbases claiming less than the subsidy and the fees keep
+// the supply below it.
+func expectedEmission(height int) int {
+	emission := 0
+
+	for _, tx := range GetGenesisBlock().Transactions {
+		emission += outputsValue(tx)
+	}
+	for h := 1; h <= height; h++ {
+		emission += GetBlockSubsidy(h)
+	}
+
+	return emission
+}
+
+// Reindex rebuilds the UTXO set by applying the main chain blocks from the
+// genesis block on. Each batch of blocks is committed along with the block the
+// UTXO set has reached, so a rebuild that is interrupted carries on from there
+// the next time the blockchain is opened. The UTXO set of a pruned blockchain
+// cannot be rebuilt, its blocks are gone.
+func (u UTXOSet) Reindex() error {
+	if u.Blockchain.PrunedHeight() > 0 {
+		return errPrunedReindex
+	}
+
+	u.replay(0)
+
+	return nil
+}
+
+// replay applies the main chain blocks from height from up to the tip to a
+// UTXO set that matches the block below, in batches of reindexBatchSize
+// blocks. Replaying from height 0 starts with an empty UTXO set.
+func (u UTXOSet) replay(from int) {
 	db := u.Blockchain.DB
-	bucketName := []byte(utxoBucket)
+	best := u.Blockchain.GetBestHeight()
 
-	err := db.Update(func(tx *bolt.Tx) error {
-		err := tx.DeleteBucket(bucketName)
-		if err != nil && err != bolt.ErrBucketNotFound {
+	for height := from; height <= best; {
+		err := db.Update(func(tx StorageTx) error {
+			if height == 0 {
+				resetChainstate(tx, nil)
+			}
+
+			b := tx.Bucket([]byte(blocksBucket))
+			hb := tx.Bucket([]byte(heightBucket))
+			for end := min(height+reindexBatchSize, best+1); height < end; height++ {
+				u.connect(tx, DeserializeBlock(b.Get(hb.Get(heightKey(height)))))
+			}
+
+			return nil
+		})
+		if err != nil {
 			log.Panic(err)
 		}
 
-		_, err = tx.CreateBucket(bucketName)
+		fmt.Fprintf(u.Blockchain.progress, "Rebuilt the UTXO set up to height %d of %d\n", height-1, best)
+	}
+}
+
+// resetChainstate replaces the UTXO set with an empty one matching block best
+func resetChainstate(tx StorageTx, best []byte) StorageBucket {
+	bucketName := []byte(utxoBucket)
+
+	err := tx.DeleteBucket(bucketName)
+	if err != nil && err != errBucketNotFound {
+		log.Panic(err)
+	}
+
+	b, err := tx.CreateBucket(bucketName)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = b.Put(bestBlockKey, best)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return b
+}
+
+// putUnspentOutputs adds the unspent outputs of a transaction to the UTXO set
+func putUnspentOutputs(b StorageBucket, entry *SnapshotEntry) {
+	for _, out := range entry.Outputs {
+		err := b.Put(outpointKey(entry.TxID, out.Position), UTXOEntry{out.Output, entry.Height, entry.Coinbase}.Serialize())
 		if err != nil {
 			log.Panic(err)
 		}
+	}
+}
+
+// Update updates the UTXO set with transactions from the Block
+// The Block is considered to be the tip of a blockchain
+func (u UTXOSet) Update(block *Block) {
+	db := u.Blockchain.DB
+
+	err := db.Update(func(tx StorageTx) error {
+		u.connect(tx, block)
 
 		return nil
 	})
 	if err != nil {
 		log.Panic(err)
 	}
+}
 
-	UTXO := u.Blockchain.FindUTXO()
+// Disconnect rolls the Block back out of the UTXO set: the outputs it
+// created are removed and the outputs it spent are restored from its undo
+// record
+// The Block is considered to be the tip of a blockchain
+func (u UTXOSet) Disconnect(block *Block) {
+	db := u.Blockchain.DB
+	undo := u.blockUndo(block)
+
+	err := db.Update(func(tx StorageTx) error {
+		u.disconnect(tx, block, undo)
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
+// connect spends the inputs and adds the outputs of the Block's transactions,
+// recording every removed output in the Block's undo record. Outputs of pruned
+// blocks are also removed from the pruned outputs.
+func (u UTXOSet) connect(tx StorageTx, block *Block) {
+	b := tx.Bucket([]byte(utxoBucket))
+	ob := tx.Bucket([]byte(prunedOutputsBucket))
+	undo := BlockUndo{}
+
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, vin := range tx.Vin {
+				key := outpointKey(vin.Txid, vin.Vout)
+				entry := DeserializeUTXOEntry(b.Get(key))
+
+				spent := SpentOutput{vin.Txid, vin.Vout, entry.Output, entry.Height, entry.Coinbase}
+				undo.SpentOutputs = append(undo.SpentOutputs, spent)
+
+				err := b.Delete(key)
+				if err == nil && ob != nil {
+					err = ob.Delete(key)
+				}
+				if err != nil {
+					log.Panic(err)
+				}
+			}
+		}
 
-		for txID, outs := range UTXO {
-			key, err := hex.DecodeString(txID)
+		for outIdx, out := range tx.Vout {
+			err := b.Put(outpointKey(tx.ID, outIdx), UTXOEntry{out, block.Height, tx.IsCoinbase()}.Serialize())
 			if err != nil {
 				log.Panic(err)
 			}
+		}
+	}
 
-			err = b.Put(key, outs.Serialize())
+	ub, err := tx.CreateBucketIfNotExists([]byte(undoBucket))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = ub.Put(block.Hash, undo.Serialize())
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = b.Put(bestBlockKey, block.Hash)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// disconnect removes the outputs of the Block's transactions and puts the
+// spent outputs back under their outpoints, and in the pruned outputs when
+// their block is pruned
+func (u UTXOSet) disconnect(tx StorageTx, block *Block, undo BlockUndo) {
+	b := tx.Bucket([]byte(utxoBucket))
+	ob := tx.Bucket([]byte(prunedOutputsBucket))
+	pruned := prunedHeight(tx)
+
+	for _, tx := range block.Transactions {
+		for outIdx := range tx.Vout {
+			err := b.Delete(outpointKey(tx.ID, outIdx))
 			if err != nil {
 				log.Panic(err)
 			}
 		}
+	}
 
-		return nil
-	})
+	for _, spent := range undo.SpentOutputs {
+		key := outpointKey(spent.Txid, spent.Position)
+		entry := UTXOEntry{spent.Output, spent.Height, spent.Coinbase}.Serialize()
+
+		err := b.Put(key, entry)
+		if err == nil && ob != nil && spent.Height < pruned {
+			err = ob.Put(key, entry)
+		}
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	if ub := tx.Bucket([]byte(undoBucket)); ub != nil {
+		err := ub.Delete(block.Hash)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	err := b.Put(bestBlockKey, block.PrevBlockHash)
 	if err != nil {
 		log.Panic(err)
 	}
 }
 
-// Update updates the UTXO set with transactions from the Block
-// The Block is considered to be the tip of a blockchain
-func (u UTXOSet) Update(block *Block) {
-	db := u.Blockchain.DB
+// rollBack disconnects the blocks the UTXO set, at block best, has applied
+// that are not on the main chain, using their undo records. It returns the
+// height of the main chain block the UTXO set is left at.
+func (u UTXOSet) rollBack(tx StorageTx, best []byte) (int, error) {
+	b := tx.Bucket([]byte(blocksBucket))
+	hb := tx.Bucket([]byte(heightBucket))
+	hash := best
+
+	for {
+		data := b.Get(hash)
+		if data == nil {
+			return 0, fmt.Errorf("Block %x is missing", hash)
+		}
+		block := DeserializeBlock(data)
 
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
+		if bytes.Equal(hb.Get(heightKey(block.Height)), hash) {
+			return block.Height, nil
+		}
 
-		for _, tx := range block.Transactions {
-			if !tx.IsCoinbase() {
-				for _, vin := range tx.Vin {
-					updatedOuts := TXOutputs{}
-					outsBytes := b.Get(vin.Txid)
-					outs := DeserializeOutputs(outsBytes)
-
-					for outIdx, out := range outs.Outputs {
-						if outIdx != vin.Vout {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
-
-					if len(updatedOuts.Outputs) == 0 {
-						err := b.Delete(vin.Txid)
-						if err != nil {
-							log.Panic(err)
-						}
-					} else {
-						err := b.Put(vin.Txid, updatedOuts.Serialize())
-						if err != nil {
-							log.Panic(err)
-						}
-					}
+		undo, err := readUndo(tx, hash)
+		if err != nil {
+			return 0, err
+		}
+		u.disconnect(tx, block, undo)
+		hash = block.PrevBlockHash
+	}
+}
 
-				}
-			}
+// blockUndo returns the undo record of the Block. Blocks connected before
+// undo records were kept get one rebuilt from the transactions they spend;
+// its outputs count as mature, since their heights are unknown.
+func (u UTXOSet) blockUndo(block *Block) BlockUndo {
+	db := u.Blockchain.DB
+	var undoData []byte
 
-			newOutputs := TXOutputs{}
-			// for _, out := range tx.Vout {
-			// 	newOutputs.Outputs = append(newOutputs.Outputs, out)
-			// }
-			newOutputs.Outputs = append(newOutputs.Outputs, tx.Vout...)
-			err := b.Put(tx.ID, newOutputs.Serialize())
-			if err != nil {
-				log.Panic(err)
+	err := db.View(func(tx StorageTx) error {
+		if ub := tx.Bucket([]byte(undoBucket)); ub != nil {
+			if data := ub.Get(block.Hash); data != nil {
+				undoData = append([]byte{}, data...)
 			}
 		}
 
@@ -193,4 +477,27 @@ func (u UTXOSet) Update(block *Block) {
 	if err != nil {
 		log.Panic(err)
 	}
+
+	if undoData != nil {
+		return DeserializeUndo(undoData)
+	}
+
+	undo := BlockUndo{}
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		for _, vin := range tx.Vin {
+			prevTX, err := u.Blockchain.FindTransaction(vin.Txid)
+			if err != nil {
+				log.Panic(err)
+			}
+
+			spent := SpentOutput{vin.Txid, vin.Vout, prevTX.Vout[vin.Vout], 0, prevTX.IsCoinbase()}
+			undo.SpentOutputs = append(undo.SpentOutputs, spent)
+		}
+	}
+
+	return undo
 }
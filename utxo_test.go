@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReindex(t *testing.T) {
+	tests := []struct {
+		name        string
+		prune       bool
+		interrupted int // height a rebuild was interrupted at, 0 for none
+		err         error
+	}{
+		{"rebuilt from the genesis block", false, 0, nil},
+		{"interrupted rebuild carries on when opened", false, 7, nil},
+		{"pruned blockchain", true, 0, errPrunedReindex},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "reindex")
+			_, miner := newTestWallet()
+			c.mineBlocks(4, miner)
+			c.mine(miner, c.send(testWallet, miner, 4, 0))
+			c.mineBlocks(15, miner)
+			if tt.prune {
+				if err := c.bc.EnablePruning(minPruneDepth); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, hash := c.bc.UTXOSnapshot()
+
+			if tt.interrupted > 0 {
+				var blocks []Block
+				for height := 0; height <= tt.interrupted; height++ {
+					block, _ := c.bc.GetBlockByHeight(height)
+					blocks = append(blocks, block)
+				}
+				update(t, c.bc.DB, func(tx StorageTx) error {
+					resetChainstate(tx, nil)
+					for i := range blocks {
+						c.utxo().connect(tx, &blocks[i])
+					}
+					return nil
+				})
+				c.reopen()
+			} else if err := c.utxo().Reindex(); err != tt.err {
+				t.Fatalf("Reindex: %v, want %v", err, tt.err)
+			}
+
+			if _, got := c.bc.UTXOSnapshot(); !bytes.Equal(got, hash) {
+				t.Error("UTXO set differs from the one of the tip")
+			}
+			if c.balance(miner) != 20*GetBlockSubsidy(1)+4 {
+				t.Errorf("Miner's balance is %d", c.balance(miner))
+			}
+		})
+	}
+}
+
+func TestUTXOStats(t *testing.T) {
+	tests := []struct {
+		name      string
+		change    func(t *testing.T, c *testChain, miner string)
+		shortfall int // of the supply against the emission, negative when above it
+	}{
+		{"coinbases claiming the subsidy and the fees", nil, 0},
+		{"coinbase claiming less", func(t *testing.T, c *testChain, miner string) {
+			c.time++
+			height := c.tip().Height + 1
+			coinbase := NewCoinbaseTX(miner, "", GetBlockSubsidy(height)-1)
+			c.add(NewBlock([]*Transaction{coinbase}, c.bc.tip, height, c.bc.CalcNextBits(c.tip()), c.time))
+		}, 1},
+		{"output never created", func(t *testing.T, c *testChain, miner string) {
+			entry := UTXOEntry{TXOutput{5, addressPubKeyHash(miner)}, 2, true}
+			putValue(t, c, utxoBucket, outpointKey(blockAt(t, c, 2).Transactions[0].ID, 7), entry.Serialize())
+		}, -5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setParams(t, func(params *ChainParams) { params.HalvingInterval = 4 })
+			c := newTestChain(t, "stats")
+			_, miner := newTestWallet()
+			_, payee := newTestWallet()
+			c.mine(miner, c.send(testWallet, payee, 3, 2))
+			c.mineBlocks(9, miner)
+			if tt.change != nil {
+				tt.change(t, c, miner)
+			}
+
+			stats := c.utxo().Stats()
+			emission := 10
+			for height := 1; height <= c.tip().Height; height++ {
+				emission += activeNetParams.Subsidy >> (height / 4)
+			}
+			if stats.Height != c.tip().Height || stats.Emission != emission {
+				t.Fatalf("Emission is %d at height %d, want %d at height %d", stats.Emission, stats.Height, emission, c.tip().Height)
+			}
+			if stats.Emission-stats.Supply != tt.shortfall {
+				t.Errorf("Supply is %d, want %d", stats.Supply, stats.Emission-tt.shortfall)
+			}
+			if stats.Supply > MaxSupply() {
+				t.Errorf("Supply %d exceeds the maximum supply %d", stats.Supply, MaxSupply())
+			}
+		})
+	}
+}
@@ -0,0 +1,706 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// A UTXO snapshot file holds the UTXO set of the main chain at one block, so
+// that a node can start from it instead of replaying the blocks below. It
+// starts with utxoSnapshotMagic and, like a chain file, is made of records: a
+// SnapshotHeader, the headers of the main chain blocks from the genesis block
+// to the snapshot block, then one SnapshotEntry per transaction, sorted by
+// transaction ID.
+var utxoSnapshotMagic = []byte("UTXS")
+
+const utxoSnapshotVersion = 1
+
+// A node that loaded a snapshot records its header in the snapshot bucket
+// until the blocks below it have been validated. Should they turn out not to
+// match the snapshot, the reason is recorded under snapshotInvalidKey and the
+// blockchain is no longer opened.
+const snapshotBucket = "snapshot"
+
+var (
+	snapshotBaseKey    = []byte("base")
+	snapshotInvalidKey = []byte("invalid")
+)
+
+// The blocks below a loaded snapshot are validated on a blockchain of their own
+const validationDbFile = "validation_%s.db"
+
+// snapshotRequestTimeout is how long the background validation waits for a
+// block before asking for it again
+const snapshotRequestTimeout = 10 * time.Second
+
+const snapshotProgressInterval = 10000
+
+// SnapshotHeader describes a UTXO snapshot: the network and block it was
+// taken at, how many transactions it holds and the hash of its UTXO set
+type SnapshotHeader struct {
+	Version     int
+	Network     string
+	Magic       [4]byte
+	GenesisHash []byte
+	BlockHash   []byte
+	Height      int
+	Count       int
+	UTXOHash    []byte
+}
+
+// SnapshotEntry is a transaction of the UTXO set with its unspent outputs
+type SnapshotEntry struct {
+	TxID     []byte
+	Height   int
+	Coinbase bool
+	Outputs  []SnapshotOutput
+}
+
+// SnapshotOutput is an unspent output and its position in the transaction
+type SnapshotOutput struct {
+	Position int
+	Output   TXOutput
+}
+
+// Serialize serializes SnapshotHeader
+func (header SnapshotHeader) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(header)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// DeserializeSnapshotHeader deserializes SnapshotHeader
+func DeserializeSnapshotHeader(data []byte) (SnapshotHeader, error) {
+	var header SnapshotHeader
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&header)
+
+	return header, err
+}
+
+// Serialize serializes SnapshotEntry
+func (entry SnapshotEntry) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(entry)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// DeserializeSnapshotEntry deserializes SnapshotEntry
+func DeserializeSnapshotEntry(data []byte) (SnapshotEntry, error) {
+	var entry SnapshotEntry
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&entry)
+
+	return entry, err
+}
+
+// writeHash feeds the entry to the UTXO set hash in a fixed layout, which
+// unlike gob does not depend on how the entry was encoded
+func (entry SnapshotEntry) writeHash(h hash.Hash) {
+	data := binary.BigEndian.AppendUint32(nil, uint32(len(entry.TxID)))
+	data = append(data, entry.TxID...)
+	data = binary.BigEndian.AppendUint64(data, uint64(entry.Height))
+	if entry.Coinbase {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+
+	data = binary.BigEndian.AppendUint32(data, uint32(len(entry.Outputs)))
+	for _, out := range entry.Outputs {
+		data = binary.BigEndian.AppendUint32(data, uint32(out.Position))
+		data = binary.BigEndian.AppendUint64(data, uint64(out.Output.Value))
+		data = binary.BigEndian.AppendUint32(data, uint32(len(out.Output.PubKeyHash)))
+		data = append(data, out.Output.PubKeyHash...)
+	}
+
+	h.Write(data)
+}
+
+// UTXOSnapshot returns the UTXO set of the tip sorted by transaction ID and
+// its hash
+func (bc *Blockchain) UTXOSnapshot() ([]SnapshotEntry, []byte) {
+	var entries []SnapshotEntry
+
+	err := bc.DB.View(func(tx StorageTx) error {
+		entries = snapshotEntries(tx)
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return entries, utxoSetHash(entries)
+}
+
+// snapshotEntries returns the UTXO set sorted by transaction ID
+func snapshotEntries(tx StorageTx) []SnapshotEntry {
+	var entries []SnapshotEntry
+	c := tx.Bucket([]byte(utxoBucket)).Cursor()
+
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if bytes.Equal(k, bestBlockKey) {
+			continue
+		}
+
+		txID, vout := splitOutpointKey(k)
+		utxo := DeserializeUTXOEntry(v)
+		if len(entries) == 0 || !bytes.Equal(entries[len(entries)-1].TxID, txID) {
+			entries = append(entries, SnapshotEntry{append([]byte{}, txID...), utxo.Height, utxo.Coinbase, nil})
+		}
+
+		entry := &entries[len(entries)-1]
+		entry.Outputs = append(entry.Outputs, SnapshotOutput{vout, utxo.Output})
+	}
+
+	return entries
+}
+
+// utxoSetHash returns the hash of a UTXO set sorted by transaction ID. It
+// only depends on the unspent outputs, so nodes with the same UTXO set have
+// the same hash however they store it.
+func utxoSetHash(entries []SnapshotEntry) []byte {
+	h := sha256.New()
+	for _, entry := range entries {
+		entry.writeHash(h)
+	}
+
+	return h.Sum(nil)
+}
+
+// DumpSnapshot writes the UTXO set of the tip as a snapshot file and returns
+// its header
+func (bc *Blockchain) DumpSnapshot(w io.Writer) (SnapshotHeader, error) {
+	entries, utxoHash := bc.UTXOSnapshot()
+
+	tip, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	header := SnapshotHeader{utxoSnapshotVersion, activeNetParams.Name, activeNetParams.Magic,
+		GetGenesisBlock().Hash, tip.Hash, tip.Height, len(entries), utxoHash}
+
+	buffered := bufio.NewWriter(w)
+	_, err = buffered.Write(utxoSnapshotMagic)
+	if err != nil {
+		return header, err
+	}
+
+	err = writeRecord(buffered, header.Serialize())
+	if err != nil {
+		return header, err
+	}
+
+	for height := 0; height <= tip.Height; height++ {
+		block, err := bc.GetBlockByHeight(height)
+		if err != nil {
+			return header, err
+		}
+
+		blockHeader := Block{block.BlockHeader, nil, block.Hash, block.Height}
+		err = writeRecord(buffered, blockHeader.Serialize())
+		if err != nil {
+			return header, err
+		}
+	}
+
+	for _, entry := range entries {
+		err = writeRecord(buffered, entry.Serialize())
+		if err != nil {
+			return header, err
+		}
+	}
+
+	return header, buffered.Flush()
+}
+
+// trustedSnapshot tells whether the network trusts a snapshot with header
+func trustedSnapshot(header SnapshotHeader) bool {
+	for _, commitment := range activeNetParams.TrustedSnapshots {
+		if commitment.Height == header.Height &&
+			commitment.BlockHash == hex.EncodeToString(header.BlockHash) &&
+			commitment.UTXOHash == hex.EncodeToString(header.UTXOHash) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LoadSnapshot makes a trusted UTXO snapshot the chainstate of a blockchain
+// that has nothing but its genesis block. The blocks below the snapshot block
+// are stored as headers, like pruned blocks, until the background validation
+// has replayed them.
+func (bc *Blockchain) LoadSnapshot(r io.Reader) (SnapshotHeader, error) {
+	buffered := bufio.NewReader(r)
+
+	magic := make([]byte, len(utxoSnapshotMagic))
+	_, err := io.ReadFull(buffered, magic)
+	if err != nil || !bytes.Equal(magic, utxoSnapshotMagic) {
+		return SnapshotHeader{}, errors.New("Not a UTXO snapshot file")
+	}
+
+	headerData, err := readRecord(buffered)
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	header, err := DeserializeSnapshotHeader(headerData)
+	if err != nil {
+		return header, err
+	}
+	if header.Version != utxoSnapshotVersion {
+		return header, fmt.Errorf("UTXO snapshot version %d is not supported", header.Version)
+	}
+	if header.Magic != activeNetParams.Magic || !bytes.Equal(header.GenesisHash, GetGenesisBlock().Hash) {
+		return header, fmt.Errorf("UTXO snapshot is for network %s, not %s", header.Network, activeNetParams.Name)
+	}
+	if !trustedSnapshot(header) {
+		return header, fmt.Errorf("UTXO snapshot of block %x at height %d with hash %x is not trusted by network %s",
+			header.BlockHash, header.Height, header.UTXOHash, activeNetParams.Name)
+	}
+	if bc.GetBestHeight() != 0 {
+		return header, errors.New("UTXO snapshots can only be loaded into a blockchain with nothing but its genesis block")
+	}
+
+	err = bc.DB.Update(func(tx StorageTx) error {
+		err := loadSnapshotHeaders(tx, buffered, header)
+		if err != nil {
+			return err
+		}
+
+		err = loadSnapshotEntries(tx, buffered, header)
+		if err != nil {
+			return err
+		}
+
+		b := tx.Bucket([]byte(blocksBucket))
+		err = b.Put([]byte("l"), header.BlockHash)
+		if err != nil {
+			log.Panic(err)
+		}
+		err = b.Put(prunedHeightKey, heightKey(header.Height+1))
+		if err != nil {
+			log.Panic(err)
+		}
+
+		sb, err := tx.CreateBucketIfNotExists([]byte(snapshotBucket))
+		if err != nil {
+			log.Panic(err)
+		}
+		err = sb.Put(snapshotBaseKey, header.Serialize())
+		if err != nil {
+			log.Panic(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return header, err
+	}
+	bc.tip = header.BlockHash
+
+	return header, nil
+}
+
+// loadSnapshotHeaders stores the headers of the blocks above the genesis
+// block up to the snapshot block, checking that they link up
+func loadSnapshotHeaders(tx StorageTx, r io.Reader, header SnapshotHeader) error {
+	b := tx.Bucket([]byte(blocksBucket))
+	var prevHash []byte
+
+	for height := 0; height <= header.Height; height++ {
+		data, err := readRecord(r)
+		if err == io.EOF {
+			return errors.New("File is truncated")
+		}
+		if err != nil {
+			return err
+		}
+		block, err := decodeBlock(data)
+		if err != nil {
+			return fmt.Errorf("Header at height %d cannot be decoded: %s", height, err)
+		}
+
+		if block.Height != height || !bytes.Equal(block.PrevBlockHash, prevHash) || !NewProofOfWork(block).Validate() {
+			return fmt.Errorf("Header at height %d is invalid", height)
+		}
+		prevHash = block.Hash
+
+		if height == 0 {
+			if !bytes.Equal(block.Hash, GetGenesisBlock().Hash) {
+				return errors.New("Headers do not start with the genesis block")
+			}
+			continue
+		}
+
+		err = b.Put(block.Hash, block.Serialize())
+		if err != nil {
+			log.Panic(err)
+		}
+		putChainWork(tx, block)
+		putHeight(tx, block)
+	}
+
+	if !bytes.Equal(prevHash, header.BlockHash) {
+		return errors.New("Headers do not end with the snapshot block")
+	}
+
+	return nil
+}
+
+// loadSnapshotEntries replaces the chainstate with the entries of the
+// snapshot, checking them against its hash. The outputs are also kept as
+// pruned outputs, like those of pruned blocks, to check the transactions
+// spending them.
+func loadSnapshotEntries(tx StorageTx, r io.Reader, header SnapshotHeader) error {
+	ub := resetChainstate(tx, header.BlockHash)
+
+	ob, err := tx.CreateBucketIfNotExists([]byte(prunedOutputsBucket))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	h := sha256.New()
+	var prevTxID []byte
+
+	for i := 1; i <= header.Count; i++ {
+		data, err := readRecord(r)
+		if err == io.EOF {
+			return errors.New("File is truncated")
+		}
+		if err != nil {
+			return err
+		}
+		entry, err := DeserializeSnapshotEntry(data)
+		if err != nil {
+			return err
+		}
+
+		if bytes.Compare(entry.TxID, prevTxID) <= 0 || len(entry.Outputs) == 0 {
+			return fmt.Errorf("Entry %d of the UTXO snapshot is invalid", i)
+		}
+		for j, out := range entry.Outputs {
+			if out.Position < 0 || j > 0 && out.Position <= entry.Outputs[j-1].Position {
+				return fmt.Errorf("Entry %d of the UTXO snapshot is invalid", i)
+			}
+		}
+		prevTxID = entry.TxID
+		entry.writeHash(h)
+
+		putUnspentOutputs(ub, &entry)
+		putUnspentOutputs(ob, &entry)
+
+		if i%snapshotProgressInterval == 0 {
+			fmt.Printf("Loaded %d of %d transactions\n", i, header.Count)
+		}
+	}
+
+	if _, err := readRecord(r); err != io.EOF {
+		return errors.New("UTXO snapshot has data after its last entry")
+	}
+	if !bytes.Equal(h.Sum(nil), header.UTXOHash) {
+		return errors.New("UTXO set does not match the hash of the snapshot")
+	}
+
+	return nil
+}
+
+// SnapshotBase returns the header of the snapshot the blockchain was loaded
+// from, as long as the blocks below it have not been validated
+func (bc *Blockchain) SnapshotBase() (SnapshotHeader, bool) {
+	var header SnapshotHeader
+	found := false
+
+	err := bc.DB.View(func(tx StorageTx) error {
+		sb := tx.Bucket([]byte(snapshotBucket))
+		if sb == nil {
+			return nil
+		}
+
+		data := sb.Get(snapshotBaseKey)
+		if data == nil {
+			return nil
+		}
+
+		var err error
+		header, err = DeserializeSnapshotHeader(data)
+		found = err == nil
+
+		return err
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return header, found
+}
+
+// checkSnapshot fails when the blocks below the snapshot the blockchain was
+// loaded from did not lead to its UTXO set
+func (bc *Blockchain) checkSnapshot() error {
+	var reason []byte
+
+	err := bc.DB.View(func(tx StorageTx) error {
+		if sb := tx.Bucket([]byte(snapshotBucket)); sb != nil {
+			reason = append([]byte{}, sb.Get(snapshotInvalidKey)...)
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if len(reason) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("UTXO snapshot the blockchain was loaded from is invalid: %s. Its UTXO set cannot be trusted, "+
+		"remove the blockchain and synchronize it again from the genesis block", reason)
+}
+
+// markSnapshotInvalid records why the snapshot the blockchain was loaded from
+// is invalid
+func (bc *Blockchain) markSnapshotInvalid(reason error) {
+	err := bc.DB.Update(func(tx StorageTx) error {
+		return tx.Bucket([]byte(snapshotBucket)).Put(snapshotInvalidKey, []byte(reason.Error()))
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// snapshotValidation replays the blocks below a loaded snapshot on a
+// blockchain of its own, fetching them from peers, and checks that it ends
+// with the UTXO set of the snapshot
+type snapshotValidation struct {
+	base   SnapshotHeader
+	dbFile string
+	chain  *Blockchain
+	blocks chan *Block
+	done   chan struct{}
+}
+
+// startSnapshotValidation starts validating the blocks below the snapshot the
+// blockchain was loaded from, if any, picking up where it was left
+func startSnapshotValidation(bc *Blockchain, nodeID string) *snapshotValidation {
+	base, found := bc.SnapshotBase()
+	if !found {
+		return nil
+	}
+
+	v := &snapshotValidation{base: base, dbFile: dataFile(validationDbFile, nodeID), blocks: make(chan *Block, 16), done: make(chan struct{})}
+	if storageExists(v.dbFile) {
+		v.chain = openBlockchain(v.dbFile, os.Stdout)
+	} else {
+		v.chain = createBlockchainAt(v.dbFile)
+	}
+
+	fmt.Printf("Validating the blocks below the UTXO snapshot in the background, at height %d of %d\n",
+		v.chain.GetBestHeight(), base.Height)
+	go v.run(bc)
+
+	return v
+}
+
+// wants tells whether block is one of the blocks the validation replays
+func (v *snapshotValidation) wants(bc *Blockchain, block *Block) bool {
+	select {
+	case <-v.done:
+		return false
+	default:
+	}
+	if block.Height > v.base.Height {
+		return false
+	}
+
+	hash, err := bc.GetBlockHash(block.Height)
+	return err == nil && bytes.Equal(hash, block.Hash)
+}
+
+// deliver hands a block received from a peer to the validation
+func (v *snapshotValidation) deliver(block *Block) {
+	select {
+	case v.blocks <- block:
+	default:
+	}
+}
+
+func (v *snapshotValidation) run(bc *Blockchain) {
+	defer close(v.done)
+
+	for {
+		height := v.chain.GetBestHeight()
+		if height >= v.base.Height {
+			err := v.finish(bc)
+			if err != nil {
+				v.fail(bc, err)
+			}
+			return
+		}
+
+		hash, err := bc.GetBlockHash(height + 1)
+		if err != nil {
+			log.Panic(err)
+		}
+		self := localAddress()
+		for _, node := range peers() {
+			if node != self {
+				sendGetData(node, "block", hash)
+				break
+			}
+		}
+
+		select {
+		case block := <-v.blocks:
+			if !bytes.Equal(block.Hash, hash) {
+				continue
+			}
+
+			err := v.chain.ValidateBlock(block)
+			if err == nil {
+				err = v.chain.AddBlock(block)
+			}
+			if err != nil {
+				v.fail(bc, fmt.Errorf("Block at height %d is invalid: %s", block.Height, err))
+				return
+			}
+
+			if block.Height%importProgressInterval == 0 {
+				fmt.Printf("Background validation at height %d of %d\n", block.Height, v.base.Height)
+			}
+		case <-time.After(snapshotRequestTimeout):
+		}
+	}
+}
+
+// finish checks the UTXO set replayed against the snapshot. When they match
+// the snapshot is no longer needed, and the blocks replayed are kept unless
+// the node prunes them.
+func (v *snapshotValidation) finish(bc *Blockchain) error {
+	_, utxoHash := v.chain.UTXOSnapshot()
+
+	if !bytes.Equal(v.chain.tip, v.base.BlockHash) || !bytes.Equal(utxoHash, v.base.UTXOHash) {
+		return fmt.Errorf("Blocks below it lead to UTXO set hash %x, not %x", utxoHash, v.base.UTXOHash)
+	}
+
+	bc.completeSnapshot(v.chain, v.base)
+	fmt.Printf("Background validation reached height %d, the UTXO snapshot is valid\n", v.base.Height)
+
+	err := v.chain.DB.Close()
+	if err != nil {
+		log.Panic(err)
+	}
+	err = removeStorage(v.dbFile)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return nil
+}
+
+// fail marks the snapshot invalid and stops the node, which must neither mine
+// nor relay on top of a UTXO set it cannot trust. The blockchain is not
+// opened again until it is synchronized from the genesis block.
+func (v *snapshotValidation) fail(bc *Blockchain, reason error) {
+	bc.markSnapshotInvalid(reason)
+
+	fmt.Println(bc.checkSnapshot())
+	os.Exit(1)
+}
+
+// completeSnapshot forgets the snapshot the blockchain was loaded from. Unless
+// the node prunes, the blocks below it are copied from the blockchain that
+// replayed them, making the node a full node again.
+func (bc *Blockchain) completeSnapshot(chain *Blockchain, base SnapshotHeader) {
+	err := bc.DB.Update(func(tx StorageTx) error {
+		if bc.pruneDepth == 0 && prunedHeight(tx) == base.Height+1 {
+			err := chain.DB.View(func(ctx StorageTx) error {
+				return copyBlocks(tx, ctx, base.Height)
+			})
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+
+		err := tx.DeleteBucket([]byte(snapshotBucket))
+		if err != nil {
+			log.Panic(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// copyBlocks stores the blocks up to height, with their undo data, from the
+// blockchain read in from and marks the blockchain written in to as not pruned
+func copyBlocks(to, from StorageTx, height int) error {
+	b := to.Bucket([]byte(blocksBucket))
+	ub, err := to.CreateBucketIfNotExists([]byte(undoBucket))
+	if err != nil {
+		return err
+	}
+
+	fromBlocks := from.Bucket([]byte(blocksBucket))
+	fromUndo := from.Bucket([]byte(undoBucket))
+	fromHeights := from.Bucket([]byte(heightBucket))
+
+	for h := 1; h <= height; h++ {
+		hash := fromHeights.Get(heightKey(h))
+
+		err := b.Put(hash, fromBlocks.Get(hash))
+		if err != nil {
+			return err
+		}
+
+		if fromUndo != nil {
+			if undo := fromUndo.Get(hash); undo != nil {
+				err = ub.Put(hash, undo)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	err = b.Delete(prunedHeightKey)
+	if err != nil {
+		return err
+	}
+
+	err = to.DeleteBucket([]byte(prunedOutputsBucket))
+	if err != nil && err != errBucketNotFound {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestLoadSnapshot(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted bool
+		change  func(file []byte, header SnapshotHeader) []byte
+		err     string
+	}{
+		{"trusted snapshot", true, nil, ""},
+		{"untrusted snapshot", false, nil, "not trusted"},
+		{"tampered entry", true, func(file []byte, header SnapshotHeader) []byte {
+			// The last record is the last entry
+			return changeRecord(file, header.Height+header.Count+1, func(data []byte) []byte {
+				entry, _ := DeserializeSnapshotEntry(data)
+				entry.Outputs[0].Output.Value++
+				return entry.Serialize()
+			})
+		}, "does not match"},
+		{"malformed header", true, func(file []byte, header SnapshotHeader) []byte {
+			return changeRecord(file, 2, func(data []byte) []byte { return bytes.Repeat([]byte{0xff}, len(data)) })
+		}, "Header at height 1 cannot be decoded"},
+		{"truncated file", true, func(file []byte, header SnapshotHeader) []byte { return file[:len(file)-10] }, "truncated"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "snapshot")
+			_, miner := newTestWallet()
+			_, payee := newTestWallet()
+			c.mine(miner, c.send(testWallet, payee, 7, 1))
+			c.mineBlocks(11, miner)
+
+			var buff bytes.Buffer
+			header, err := c.bc.DumpSnapshot(&buff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file := buff.Bytes()
+			if tt.change != nil {
+				file = tt.change(file, header)
+			}
+			if tt.trusted {
+				trustSnapshot(t, header)
+			}
+
+			to := newTestChain(t, "load")
+			to.time = c.time
+			_, err = to.bc.LoadSnapshot(bytes.NewReader(file))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Load: %v, want %q", err, tt.err)
+				}
+				if to.bc.GetBestHeight() != 0 {
+					t.Error("Failed load is not rolled back")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(to.bc.tip, c.bc.tip) {
+				t.Errorf("Tip is at height %d, want %d", to.tip().Height, c.tip().Height)
+			}
+			if to.balance(payee) != 7 || to.balance(miner) != c.balance(miner) {
+				t.Errorf("Balances are %d and %d, want 7 and %d", to.balance(payee), to.balance(miner), c.balance(miner))
+			}
+			if _, found := to.bc.SnapshotBase(); !found {
+				t.Error("Snapshot base is not recorded")
+			}
+			checkPrunedOutputs(t, to)
+
+			// Outputs of the snapshot can be spent
+			to.mine(miner, to.send(testWallet, miner, 2, 0))
+			if to.balance(miner) != c.balance(miner)+GetBlockSubsidy(to.tip().Height)+2 {
+				t.Errorf("Miner's balance is %d", to.balance(miner))
+			}
+		})
+	}
+}
+
+func TestSnapshotValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		other bool // the blocks replayed are those of another chain
+		err   string
+	}{
+		{"blocks lead to the snapshot", false, ""},
+		{"blocks lead to another UTXO set", true, "lead to UTXO set hash"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "snapshot")
+			_, miner := newTestWallet()
+			c.mine(miner, c.send(testWallet, miner, 7, 1))
+			c.mineBlocks(11, miner)
+
+			var buff bytes.Buffer
+			header, err := c.bc.DumpSnapshot(&buff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			trustSnapshot(t, header)
+
+			to := newTestChain(t, "load")
+			if _, err := to.bc.LoadSnapshot(&buff); err != nil {
+				t.Fatal(err)
+			}
+
+			from := c
+			if tt.other {
+				from = newTestChain(t, "other")
+				from.mineBlocks(header.Height, miner)
+			}
+
+			v := &snapshotValidation{base: header, dbFile: dataFile(validationDbFile, to.nodeID), blocks: make(chan *Block, 16), done: make(chan struct{})}
+			v.chain = createBlockchainAt(v.dbFile)
+			t.Cleanup(func() {
+				if storageExists(v.dbFile) {
+					v.chain.DB.Close()
+					removeStorage(v.dbFile)
+				}
+			})
+			for height := 1; height <= header.Height; height++ {
+				block, err := from.bc.GetBlockByHeight(height)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := v.chain.ValidateBlock(&block); err != nil {
+					t.Fatal(err)
+				}
+				if err := v.chain.AddBlock(&block); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = v.finish(to.bc)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Validation: %v, want %q", err, tt.err)
+				}
+				to.bc.markSnapshotInvalid(err)
+				if err := to.bc.checkSnapshot(); err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Snapshot check: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, found := to.bc.SnapshotBase(); found {
+				t.Error("Snapshot base is kept")
+			}
+			if err := to.bc.checkSnapshot(); err != nil {
+				t.Error(err)
+			}
+			if to.bc.PrunedHeight() != 0 {
+				t.Error("Blocks below the snapshot are not copied")
+			}
+			if storageExists(v.dbFile) {
+				t.Error("Blockchain of the validation is kept")
+			}
+		})
+	}
+}
+
+// trustSnapshot makes the test network trust the snapshot until the test ends
+func trustSnapshot(t *testing.T, header SnapshotHeader) {
+	setParams(t, func(params *ChainParams) {
+		params.TrustedSnapshots = []SnapshotCommitment{{header.Height, hex.EncodeToString(header.BlockHash), hex.EncodeToString(header.UTXOHash)}}
+	})
+}
+
+// changeRecord returns the snapshot file with its nth record after the magic
+// changed
+func changeRecord(file []byte, n int, change func(data []byte) []byte) []byte {
+	r := bytes.NewReader(file[len(utxoSnapshotMagic):])
+	for i := 0; i < n; i++ {
+		readRecord(r)
+	}
+	start := len(file) - r.Len()
+	data, _ := readRecord(r)
+
+	var buff bytes.Buffer
+	buff.Write(file[:start])
+	writeRecord(&buff, change(data))
+	buff.Write(file[len(file)-r.Len():])
+
+	return buff.Bytes()
+}
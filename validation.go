@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// A block has to be newer than the median of the medianTimeBlocks blocks
+// before it, and at most MaxFutureBlockTime seconds ahead of adjusted time
+const medianTimeBlocks = 11
+
+// A block may be at most maxBlockSize bytes serialized and may need at most
+// maxBlockSigOps signature checks, one for every input it spends
+const maxBlockSize = 1 << 20
+const maxBlockSigOps = maxBlockSize / 50
+
+var errOrphanBlock = errors.New("Previous block is unknown")
+var errFutureBlock = errors.New("Block timestamp is too far in the future")
+
+// ValidateBlock checks a block against the consensus rules before it is stored.
+// Checks that depend on the UTXO set are only possible when the block builds
+// on the current tip.
+func (bc *Blockchain) ValidateBlock(block *Block) error {
+	if len(block.Transactions) == 0 {
+		return errors.New("Block has no transactions")
+	}
+
+	if size := len(block.Serialize()); size > maxBlockSize {
+		return fmt.Errorf("Block is %d bytes, the limit is %d", size, maxBlockSize)
+	}
+
+	sigOps := 0
+	for _, tx := range block.Transactions {
+		sigOps += countSigOps(tx)
+	}
+	if sigOps > maxBlockSigOps {
+		return fmt.Errorf("Block needs %d signature checks, the limit is %d", sigOps, maxBlockSigOps)
+	}
+
+	pow := NewProofOfWork(block)
+	if !pow.Validate() {
+		return errors.New("Proof of work is invalid")
+	}
+
+	if block.Timestamp > adjustedTime()+activeNetParams.MaxFutureBlockTime {
+		return errFutureBlock
+	}
+
+	if len(block.PrevBlockHash) == 0 {
+		return errors.New("Block claims to be a genesis block")
+	}
+
+	// The header only serializes 32 bytes of each hash, so blocks with other
+	// lengths would share the hash of a different block
+	if len(block.PrevBlockHash) != 32 || len(block.MerkleRoot) != 32 {
+		return errors.New("Block header hashes are not 32 bytes long")
+	}
+
+	parent, err := bc.GetBlock(block.PrevBlockHash)
+	if err != nil {
+		return errOrphanBlock
+	}
+
+	if block.Height != parent.Height+1 {
+		return fmt.Errorf("Height %d does not follow parent height %d", block.Height, parent.Height)
+	}
+
+	if medianTime := bc.CalcPastMedianTime(&parent); block.Timestamp <= medianTime {
+		return fmt.Errorf("Timestamp %d is not after the median time %d", block.Timestamp, medianTime)
+	}
+
+	if expected := bc.CalcNextBits(&parent); block.Bits != expected {
+		return fmt.Errorf("Target bits %08x differ from the expected %08x", block.Bits, expected)
+	}
+
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return errors.New("Merkle root does not match the transactions")
+	}
+
+	// The Merkle root commits to the serialized transactions, their IDs still
+	// have to be checked against what they were hashed from. Repeating the
+	// last transactions of a block can keep its Merkle root, as the tree
+	// pairs an odd last node with itself, so no ID may appear twice.
+	coinbases := 0
+	ids := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		if err := checkTransaction(tx); err != nil {
+			return err
+		}
+		if ids[string(tx.ID)] {
+			return fmt.Errorf("Transaction %x appears twice in the block", tx.ID)
+		}
+		ids[string(tx.ID)] = true
+		if tx.IsCoinbase() {
+			coinbases++
+		}
+	}
+	if coinbases != 1 {
+		return fmt.Errorf("Block has %d coinbase transactions", coinbases)
+	}
+
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	if !bytes.Equal(block.PrevBlockHash, bc.tip) {
+		return nil
+	}
+
+	return bc.DB.View(func(tx StorageTx) error {
+		return bc.validateTransactions(tx, block)
+	})
+}
+
+// checkTransaction runs the checks of a transaction that need nothing but the
+// transaction itself
+func checkTransaction(tx *Transaction) error {
+	if !bytes.Equal(tx.ID, unsignedHash(tx)) {
+		return fmt.Errorf("Transaction %x has a wrong ID", tx.ID)
+	}
+
+	return checkOutputs(tx)
+}
+
+// checkOutputs checks that no output of a transaction is negative and that
+// the outputs add up to no more than an int holds, so that their value can be
+// trusted in a fee
+func checkOutputs(tx *Transaction) error {
+	total := 0
+
+	for _, out := range tx.Vout {
+		if out.Value < 0 {
+			return fmt.Errorf("Transaction %x has a negative output", tx.ID)
+		}
+		if out.Value > math.MaxInt-total {
+			return fmt.Errorf("Transaction %x has outputs adding up to more than %d", tx.ID, math.MaxInt)
+		}
+		total += out.Value
+	}
+
+	return nil
+}
+
+// validateTransaction checks a transaction waiting to be mined as if it were
+// the only one of a block on the tip
+func (bc *Blockchain) validateTransaction(tx *Transaction) error {
+	if tx.IsCoinbase() {
+		return fmt.Errorf("Transaction %x is a coinbase", tx.ID)
+	}
+
+	err := checkTransaction(tx)
+	if err != nil {
+		return err
+	}
+
+	block := &Block{Transactions: []*Transaction{tx}, Height: bc.GetBestHeight() + 1}
+
+	return bc.DB.View(func(dbTx StorageTx) error {
+		return bc.validateTransactions(dbTx, block)
+	})
+}
+
+// validateTransactions checks signatures and spent outputs of the block's
+// transactions against the UTXO set of the tip within dbTx, and that the
+// coinbase claims no more than the block subsidy plus the fees
+func (bc *Blockchain) validateTransactions(dbTx StorageTx, block *Block) error {
+	b := dbTx.Bucket([]byte(utxoBucket))
+	spent := make(map[string]bool)
+	claimed := 0
+	fees := 0
+
+	for _, tx := range block.Transactions {
+		err := checkOutputs(tx)
+		if err != nil {
+			return err
+		}
+
+		if tx.IsCoinbase() {
+			claimed += outputsValue(tx)
+			continue
+		}
+
+		if len(tx.Vin) == 0 || len(tx.Vout) == 0 {
+			return fmt.Errorf("Transaction %x has no inputs or outputs", tx.ID)
+		}
+
+		inputs := 0
+		prevTXs := make(map[string]Transaction)
+		for _, vin := range tx.Vin {
+			outpoint := fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)
+			if spent[outpoint] {
+				return fmt.Errorf("Transaction %x spends %s twice in the block", tx.ID, outpoint)
+			}
+			spent[outpoint] = true
+
+			data := b.Get(outpointKey(vin.Txid, vin.Vout))
+			if vin.Vout < 0 || data == nil {
+				return fmt.Errorf("Transaction %x spends missing or spent output %s", tx.ID, outpoint)
+			}
+			entry := DeserializeUTXOEntry(data)
+			if !entry.IsMature(block.Height) {
+				return fmt.Errorf("Transaction %x spends immature coinbase output %s", tx.ID, outpoint)
+			}
+			if !vin.UsesKey(entry.Output.PubKeyHash) {
+				return fmt.Errorf("Transaction %x spends %s with a foreign key", tx.ID, outpoint)
+			}
+			inputs += entry.Output.Value
+
+			// Verify only reads the outputs the inputs spend
+			prevTX := prevTXs[hex.EncodeToString(vin.Txid)]
+			prevTX.ID = vin.Txid
+			for len(prevTX.Vout) <= vin.Vout {
+				prevTX.Vout = append(prevTX.Vout, TXOutput{})
+			}
+			prevTX.Vout[vin.Vout] = entry.Output
+			prevTXs[hex.EncodeToString(vin.Txid)] = prevTX
+		}
+
+		outputs := outputsValue(tx)
+		if outputs > inputs {
+			return fmt.Errorf("Transaction %x spends %d but only has %d", tx.ID, outputs, inputs)
+		}
+		fees += inputs - outputs
+
+		if !tx.Verify(prevTXs) {
+			return fmt.Errorf("Transaction %x has an invalid signature", tx.ID)
+		}
+	}
+
+	if reward := GetBlockSubsidy(block.Height) + fees; claimed > reward {
+		return fmt.Errorf("Coinbase claims %d but subsidy and fees are %d", claimed, reward)
+	}
+
+	return nil
+}
+
+// outputsValue returns the total value of the transaction's outputs
+func outputsValue(tx *Transaction) int {
+	total := 0
+
+	for _, out := range tx.Vout {
+		total += out.Value
+	}
+
+	return total
+}
+
+// countSigOps returns the number of signature checks a transaction needs
+func countSigOps(tx *Transaction) int {
+	if tx.IsCoinbase() {
+		return 0
+	}
+
+	return len(tx.Vin)
+}
+
+// unsignedHash returns the hash a transaction ID is made from. IDs are
+// assigned before the inputs are signed, so signatures are left out.
+func unsignedHash(tx *Transaction) []byte {
+	txCopy := *tx
+	txCopy.Vin = make([]TXInput, len(tx.Vin))
+
+	for i, vin := range tx.Vin {
+		txCopy.Vin[i] = TXInput{vin.Txid, vin.Vout, nil, vin.PubKey}
+	}
+
+	return txCopy.Hash()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateBlockTimestamp(t *testing.T) {
+	hour := int64(60 * 60)
+
+	tests := []struct {
+		name      string
+		timestamp func(c *testChain) int64
+		maxFuture int64 // MaxFutureBlockTime, the network's when 0
+		offset    int64 // clock offset reported by a peer
+		err       string
+	}{
+		{"after the median time", func(c *testChain) int64 { return c.time - 4 }, 0, 0, ""},
+		{"at the median time", func(c *testChain) int64 { return c.time - 5 }, 0, 0, "median time"},
+		{"before the median time", func(c *testChain) int64 { return c.time - 9 }, 0, 0, "median time"},
+		{"within the future limit", func(c *testChain) int64 { return time.Now().Unix() + 2*hour - 60 }, 0, 0, ""},
+		{"beyond the future limit", func(c *testChain) int64 { return time.Now().Unix() + 2*hour + 60 }, 0, 0, errFutureBlock.Error()},
+		{"within a longer future limit", func(c *testChain) int64 { return time.Now().Unix() + 3*hour }, 4 * hour, 0, ""},
+		{"beyond a shorter future limit", func(c *testChain) int64 { return time.Now().Unix() + hour }, hour / 2, 0, errFutureBlock.Error()},
+		{"within the limit of a peer's clock", func(c *testChain) int64 { return time.Now().Unix() + 2*hour + 30*60 }, 0, hour, ""},
+		{"peer's clock too far off to count", func(c *testChain) int64 { return time.Now().Unix() + 2*hour + 30*60 }, 0, 2 * hour, errFutureBlock.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.maxFuture != 0 {
+				setParams(t, func(params *ChainParams) { params.MaxFutureBlockTime = tt.maxFuture })
+			}
+			if tt.offset != 0 {
+				addTimeSample("peer", time.Now().Unix()+tt.offset)
+				t.Cleanup(func() {
+					timeOffsetsLock.Lock()
+					delete(timeOffsets, "peer")
+					timeOffsetsLock.Unlock()
+				})
+			}
+
+			// The genesis block and ten more, one second apart, so the
+			// median time is five seconds before the tip
+			c := newTestChain(t, "timestamp")
+			_, miner := newTestWallet()
+			c.mineBlocks(10, miner)
+
+			tip := c.tip()
+			block := NewBlock([]*Transaction{NewCoinbaseTX(miner, "", GetBlockSubsidy(tip.Height+1))}, tip.Hash, tip.Height+1, c.bc.CalcNextBits(tip), tt.timestamp(c))
+
+			err := c.bc.ValidateBlock(block)
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("Block: %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidateBlockLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(block *Block)
+		err    string
+	}{
+		{"too large", func(block *Block) {
+			block.Transactions[0].Vout[0].PubKeyHash = make([]byte, maxBlockSize)
+		}, "bytes"},
+		{"too many signature checks", func(block *Block) {
+			// Unsigned inputs are small enough to reach the signature check
+			// limit before the size limit
+			tx := &Transaction{nil, make([]TXInput, maxBlockSigOps+1), []TXOutput{{1, nil}}}
+			for i := range tx.Vin {
+				tx.Vin[i] = TXInput{block.Transactions[0].ID, i, nil, nil}
+			}
+			tx.ID = tx.Hash()
+			block.Transactions = append(block.Transactions, tx)
+		}, "signature checks"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "limits")
+			_, miner := newTestWallet()
+
+			tip := c.tip()
+			c.time++
+			coinbase := NewCoinbaseTX(miner, "", GetBlockSubsidy(tip.Height+1))
+			block := &Block{Transactions: []*Transaction{coinbase}}
+			tt.change(block)
+			block = NewBlock(block.Transactions, tip.Hash, tip.Height+1, c.bc.CalcNextBits(tip), c.time)
+
+			if err := c.bc.ValidateBlock(block); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Block: %v", err)
+			}
+		})
+	}
+}
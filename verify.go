@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// Levels of chain verification, each including the ones below
+const (
+	// verifyHeaders checks proof of work, targets, timestamps, heights and
+	// that every block links to the one below it
+	verifyHeaders = iota
+	// verifyBlocks also checks Merkle roots, transaction IDs, sizes and
+	// coinbases
+	verifyBlocks
+	// verifyTransactions also checks the signatures of the transactions and
+	// that they create no coins, against the outputs in the undo records
+	verifyTransactions
+	// verifyUTXO also rebuilds the UTXO set from the blocks and compares it
+	// with the chainstate
+	verifyUTXO
+)
+
+var errVerifyPruned = errors.New("UTXO set of a pruned blockchain cannot be rebuilt from its blocks, verify it at level 2 or lower")
+
+// ChainError is the first inconsistency VerifyChain finds: the level of the
+// check that failed and the block it failed for
+type ChainError struct {
+	Level  int
+	Height int
+	Hash   []byte
+	Err    error
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("Block %x at height %d: %s", e.Hash, e.Height, e.Err)
+}
+
+// VerifyChain checks the stored main chain again at level, from the genesis
+// block or, when depth is positive, only the latest depth blocks. The UTXO
+// set is always rebuilt from the whole chain. It returns the number of blocks
+// checked and a *ChainError for the lowest block found inconsistent.
+func (bc *Blockchain) VerifyChain(depth, level int) (int, error) {
+	best := bc.GetBestHeight()
+	if level >= verifyUTXO && bc.PrunedHeight() > 0 {
+		return 0, errVerifyPruned
+	}
+
+	from := 0
+	if depth > 0 && depth <= best {
+		from = best - depth + 1
+	}
+	prunedHeight := bc.PrunedHeight()
+	var prev *Block
+
+	for height := from; height <= best; height++ {
+		hash, err := bc.GetBlockHash(height)
+		if err != nil {
+			return height - from, &ChainError{verifyHeaders, height, nil, errors.New("Height index has no block")}
+		}
+
+		block, err := bc.verifyHeader(hash, height, prev)
+		if err != nil {
+			return height - from, &ChainError{verifyHeaders, height, hash, err}
+		}
+		prev = block
+
+		if level < verifyBlocks || height < prunedHeight {
+			continue
+		}
+		if block.IsPruned() {
+			return height - from, &ChainError{verifyBlocks, height, hash, errors.New("Block has no transactions")}
+		}
+		err = verifyBlockContent(block)
+		if err != nil {
+			return height - from, &ChainError{verifyBlocks, height, hash, err}
+		}
+
+		if level < verifyTransactions || height == 0 {
+			continue
+		}
+		err = bc.verifyBlockTransactions(block)
+		if err != nil {
+			return height - from, &ChainError{verifyTransactions, height, hash, err}
+		}
+	}
+
+	if level >= verifyUTXO {
+		err := bc.verifyChainstate()
+		if err != nil {
+			return best - from + 1, &ChainError{verifyUTXO, best, bc.tip, err}
+		}
+	}
+
+	return best - from + 1, nil
+}
+
+// verifyHeader decodes the main chain block at height and checks its header
+// against the block below it, prev, which is looked up when nil
+func (bc *Blockchain) verifyHeader(hash []byte, height int, prev *Block) (*Block, error) {
+	var data []byte
+
+	err := bc.DB.View(func(tx StorageTx) error {
+		data = append([]byte{}, tx.Bucket([]byte(blocksBucket)).Get(hash)...)
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("Block is missing")
+	}
+
+	var block Block
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&block)
+	if err != nil {
+		return nil, fmt.Errorf("Block cannot be decoded: %s", err)
+	}
+
+	if !bytes.Equal(block.Hash, hash) || !NewProofOfWork(&block).Validate() {
+		return nil, errors.New("Proof of work is invalid")
+	}
+	if height > 0 && len(block.PrevBlockHash) != 32 || len(block.MerkleRoot) != 32 {
+		return nil, errors.New("Block header hashes are not 32 bytes long")
+	}
+	if block.Height != height {
+		return nil, fmt.Errorf("Block claims height %d", block.Height)
+	}
+
+	if height == 0 {
+		if !bytes.Equal(hash, GetGenesisBlock().Hash) {
+			return nil, errors.New("Block is not the genesis block of the network")
+		}
+		return &block, nil
+	}
+
+	if prev == nil {
+		prevBlock, err := bc.GetBlock(block.PrevBlockHash)
+		if err != nil {
+			return nil, fmt.Errorf("Previous block cannot be read: %s", err)
+		}
+		prev = &prevBlock
+
+		// The checks below read the blocks under prev, which are not verified
+		err = bc.checkAncestors(prev, max(medianTimeBlocks, activeNetParams.RetargetInterval))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !bytes.Equal(block.PrevBlockHash, prev.Hash) {
+		return nil, fmt.Errorf("Block links to %x, not to block %x below it", block.PrevBlockHash, prev.Hash)
+	}
+	if expected := bc.CalcNextBits(prev); block.Bits != expected {
+		return nil, fmt.Errorf("Target bits %08x differ from the expected %08x", block.Bits, expected)
+	}
+	if medianTime := bc.CalcPastMedianTime(prev); block.Timestamp <= medianTime {
+		return nil, fmt.Errorf("Timestamp %d is not after the median time %d", block.Timestamp, medianTime)
+	}
+
+	return &block, nil
+}
+
+// checkAncestors checks that the n blocks below block can be read
+func (bc *Blockchain) checkAncestors(block *Block, n int) error {
+	for i := 0; i < n && len(block.PrevBlockHash) > 0; i++ {
+		prev, err := bc.GetBlock(block.PrevBlockHash)
+		if err != nil {
+			return fmt.Errorf("Block %x below it cannot be read: %s", block.PrevBlockHash, err)
+		}
+		block = &prev
+	}
+
+	return nil
+}
+
+// verifyBlockContent checks what a block commits to without looking at other
+// blocks
+func verifyBlockContent(block *Block) error {
+	if size := len(block.Serialize()); size > maxBlockSize {
+		return fmt.Errorf("Block is %d bytes, the limit is %d", size, maxBlockSize)
+	}
+
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return errors.New("Merkle root does not match the transactions")
+	}
+
+	coinbases := 0
+	ids := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		if !bytes.Equal(tx.ID, unsignedHash(tx)) {
+			return fmt.Errorf("Transaction %x has a wrong ID", tx.ID)
+		}
+		if ids[string(tx.ID)] {
+			return fmt.Errorf("Transaction %x appears twice in the block", tx.ID)
+		}
+		ids[string(tx.ID)] = true
+		if tx.IsCoinbase() {
+			coinbases++
+		}
+		for _, out := range tx.Vout {
+			if out.Value < 0 {
+				return fmt.Errorf("Transaction %x has a negative output", tx.ID)
+			}
+		}
+	}
+	if coinbases != 1 {
+		return fmt.Errorf("Block has %d coinbase transactions", coinbases)
+	}
+
+	return nil
+}
+
+// verifyBlockTransactions checks the signatures of the block's transactions
+// and that they spend no more than the outputs recorded in its undo record,
+// which are checked against the transactions that created them unless those
+// are pruned. A missing undo record is an inconsistency: it is not rebuilt
+// from the transactions spent like blocks connected before undo records were
+// kept get one.
+func (bc *Blockchain) verifyBlockTransactions(block *Block) error {
+	var undo BlockUndo
+	err := bc.DB.View(func(tx StorageTx) error {
+		var err error
+		undo, err = readUndo(tx, block.Hash)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	spent := undo.SpentOutputs
+	claimed := 0
+	fees := 0
+	created := make(map[int]Block)
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			claimed += outputsValue(tx)
+			continue
+		}
+
+		inputs := 0
+		prevTXs := make(map[string]Transaction)
+		for _, vin := range tx.Vin {
+			if len(spent) == 0 {
+				return errors.New("Undo record has fewer outputs than the block spends")
+			}
+			out := spent[0]
+			spent = spent[1:]
+
+			outpoint := fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)
+			if vin.Vout < 0 {
+				return fmt.Errorf("Transaction %x spends output %s, which cannot exist", tx.ID, outpoint)
+			}
+			if !bytes.Equal(out.Txid, vin.Txid) || out.Position != vin.Vout {
+				return fmt.Errorf("Undo record does not hold output %s that transaction %x spends", outpoint, tx.ID)
+			}
+			err := bc.verifySpentOutput(out, created)
+			if err != nil {
+				return fmt.Errorf("Undo record holds output %s %s", outpoint, err)
+			}
+			if out.Coinbase && out.Height > 0 && block.Height-out.Height < activeNetParams.CoinbaseMaturity {
+				return fmt.Errorf("Transaction %x spends immature coinbase output %s", tx.ID, outpoint)
+			}
+			if !vin.UsesKey(out.Output.PubKeyHash) {
+				return fmt.Errorf("Transaction %x spends %s with a foreign key", tx.ID, outpoint)
+			}
+			inputs += out.Output.Value
+
+			// Verify only reads the outputs the inputs spend
+			prevTX := prevTXs[hex.EncodeToString(vin.Txid)]
+			prevTX.ID = vin.Txid
+			for len(prevTX.Vout) <= vin.Vout {
+				prevTX.Vout = append(prevTX.Vout, TXOutput{})
+			}
+			prevTX.Vout[vin.Vout] = out.Output
+			prevTXs[hex.EncodeToString(vin.Txid)] = prevTX
+		}
+
+		if outputs := outputsValue(tx); outputs > inputs {
+			return fmt.Errorf("Transaction %x spends %d but only has %d", tx.ID, outputs, inputs)
+		} else {
+			fees += inputs - outputs
+		}
+
+		if !tx.Verify(prevTXs) {
+			return fmt.Errorf("Transaction %x has an invalid signature", tx.ID)
+		}
+	}
+
+	if len(spent) > 0 {
+		return errors.New("Undo record has more outputs than the block spends")
+	}
+	if reward := GetBlockSubsidy(block.Height) + fees; claimed > reward {
+		return fmt.Errorf("Coinbase claims %d but subsidy and fees are %d", claimed, reward)
+	}
+
+	return nil
+}
+
+// verifySpentOutput compares an output of an undo record with the output of
+// the main chain block at its height, keeping the blocks read in created
+func (bc *Blockchain) verifySpentOutput(out SpentOutput, created map[int]Block) error {
+	block, ok := created[out.Height]
+	if !ok {
+		var err error
+		block, err = bc.GetBlockByHeight(out.Height)
+		if err != nil {
+			return fmt.Errorf("from height %d, which has no block", out.Height)
+		}
+		created[out.Height] = block
+	}
+	if block.IsPruned() {
+		return nil
+	}
+
+	for _, tx := range block.Transactions {
+		if !bytes.Equal(tx.ID, out.Txid) {
+			continue
+		}
+
+		if out.Position >= len(tx.Vout) || tx.IsCoinbase() != out.Coinbase ||
+			tx.Vout[out.Position].Value != out.Output.Value ||
+			!bytes.Equal(tx.Vout[out.Position].PubKeyHash, out.Output.PubKeyHash) {
+			return errors.New("differently from its transaction")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("from block %x, which has no such transaction", block.Hash)
+}
+
+// verifyChainstate rebuilds the UTXO set of the tip from the blocks, without
+// touching the chainstate, and compares the two output by output
+func (bc *Blockchain) verifyChainstate() error {
+	var best []byte
+	var stored, shadow []SnapshotEntry
+	var corrupt error
+
+	err := bc.DB.View(func(tx StorageTx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		if b == nil {
+			corrupt = errors.New("UTXO set is missing")
+			return nil
+		}
+		best = append([]byte{}, b.Get(bestBlockKey)...)
+
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var entry UTXOEntry
+			if bytes.Equal(k, bestBlockKey) {
+				continue
+			}
+			if len(k) <= 4 || gob.NewDecoder(bytes.NewReader(v)).Decode(&entry) != nil {
+				corrupt = fmt.Errorf("UTXO set has an entry that cannot be decoded under key %x", k)
+				return nil
+			}
+		}
+
+		stored = snapshotEntries(tx)
+		UTXO, err := unspentOutputs(tx, bc.tip)
+		if err != nil {
+			corrupt = fmt.Errorf("UTXO set cannot be rebuilt: %s", err)
+			return nil
+		}
+		for _, entry := range UTXO {
+			shadow = append(shadow, *entry)
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if corrupt != nil {
+		return corrupt
+	}
+	if !bytes.Equal(best, bc.tip) {
+		return fmt.Errorf("UTXO set is at block %x, not at the tip", best)
+	}
+
+	sort.Slice(shadow, func(i, j int) bool {
+		return bytes.Compare(shadow[i].TxID, shadow[j].TxID) < 0
+	})
+	if bytes.Equal(utxoSetHash(stored), utxoSetHash(shadow)) {
+		return nil
+	}
+
+	storedOutputs, shadowOutputs := outpointEntries(stored), outpointEntries(shadow)
+	for len(storedOutputs) > 0 || len(shadowOutputs) > 0 {
+		cmp := 0
+		switch {
+		case len(storedOutputs) == 0:
+			cmp = 1
+		case len(shadowOutputs) == 0:
+			cmp = -1
+		default:
+			cmp = bytes.Compare(storedOutputs[0].key, shadowOutputs[0].key)
+		}
+
+		if cmp < 0 {
+			return fmt.Errorf("UTXO set has output %s, which the blocks spend or never created", storedOutputs[0])
+		}
+		if cmp > 0 {
+			return fmt.Errorf("UTXO set misses unspent output %s", shadowOutputs[0])
+		}
+		if storedOutputs[0].entry != shadowOutputs[0].entry {
+			return fmt.Errorf("UTXO set has output %s as %s, the blocks as %s",
+				storedOutputs[0], storedOutputs[0].entry, shadowOutputs[0].entry)
+		}
+
+		storedOutputs, shadowOutputs = storedOutputs[1:], shadowOutputs[1:]
+	}
+
+	return nil
+}
+
+// outpointEntry is an unspent output under its outpoint key, in a form that
+// compares with ==
+type outpointEntry struct {
+	key   []byte
+	entry string
+}
+
+func (o outpointEntry) String() string {
+	txID, vout := splitOutpointKey(o.key)
+	return fmt.Sprintf("%x:%d", txID, vout)
+}
+
+// outpointEntries lists the outputs of a UTXO set sorted by outpoint key
+func outpointEntries(entries []SnapshotEntry) []outpointEntry {
+	var outputs []outpointEntry
+
+	for _, entry := range entries {
+		for _, out := range entry.Outputs {
+			description := fmt.Sprintf("%d to %x at height %d", out.Output.Value, out.Output.PubKeyHash, entry.Height)
+			if entry.Coinbase {
+				description += " by a coinbase"
+			}
+			outputs = append(outputs, outpointEntry{outpointKey(entry.TxID, out.Position), description})
+		}
+	}
+
+	return outputs
+}
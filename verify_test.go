@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyChain(t *testing.T) {
+	tests := []struct {
+		name         string
+		change       func(t *testing.T, c *testChain)
+		depth, level int
+		failLevel    int // level of the inconsistency found, -1 for none
+		err          string
+	}{
+		{"consistent chain", nil, 0, verifyUTXO, -1, ""},
+		{"latest blocks of a consistent chain", nil, 5, verifyUTXO, -1, ""},
+		{"height index pointing at another block", func(t *testing.T, c *testChain) {
+			putValue(t, c, heightBucket, heightKey(4), hashAt(t, c, 5))
+		}, 0, verifyHeaders, verifyHeaders, "claims height 5"},
+		{"inconsistency below the latest blocks", func(t *testing.T, c *testChain) {
+			putValue(t, c, heightBucket, heightKey(4), hashAt(t, c, 5))
+		}, 5, verifyUTXO, -1, ""},
+		{"block that cannot be decoded", func(t *testing.T, c *testChain) {
+			putValue(t, c, blocksBucket, hashAt(t, c, 3), []byte("junk"))
+		}, 0, verifyHeaders, verifyHeaders, "cannot be decoded"},
+		{"block under the latest blocks that cannot be decoded", func(t *testing.T, c *testChain) {
+			putValue(t, c, blocksBucket, hashAt(t, c, c.tip().Height-7), []byte("junk"))
+		}, 5, verifyHeaders, verifyHeaders, "below it cannot be read"},
+		{"coinbase changed", func(t *testing.T, c *testChain) {
+			block, _ := c.bc.GetBlockByHeight(2)
+			block.Transactions[0].Vout[0].Value = 1000
+			putValue(t, c, blocksBucket, block.Hash, block.Serialize())
+		}, 0, verifyBlocks, verifyBlocks, "Merkle root"},
+		{"undo record spending more", func(t *testing.T, c *testChain) {
+			undo := c.utxo().blockUndo(blockAt(t, c, 2))
+			undo.SpentOutputs[0].Output.Value += 100
+			putValue(t, c, undoBucket, hashAt(t, c, 2), undo.Serialize())
+		}, 0, verifyTransactions, verifyTransactions, "differently from its transaction"},
+		{"undo record missing", func(t *testing.T, c *testChain) {
+			putValue(t, c, undoBucket, hashAt(t, c, 2), nil)
+		}, 0, verifyTransactions, verifyTransactions, "is missing"},
+		{"undo record that cannot be decoded", func(t *testing.T, c *testChain) {
+			putValue(t, c, undoBucket, hashAt(t, c, 2), []byte("junk"))
+		}, 0, verifyTransactions, verifyTransactions, "is corrupt"},
+		{"unspent output missing", func(t *testing.T, c *testChain) {
+			putValue(t, c, utxoBucket, outpointKey(blockAt(t, c, 2).Transactions[0].ID, 0), nil)
+		}, 0, verifyUTXO, verifyUTXO, "misses unspent output"},
+		{"output never created", func(t *testing.T, c *testChain) {
+			entry := UTXOEntry{TXOutput{5, []byte("x")}, 2, true}
+			putValue(t, c, utxoBucket, outpointKey(blockAt(t, c, 2).Transactions[0].ID, 7), entry.Serialize())
+		}, 0, verifyUTXO, verifyUTXO, "never created"},
+		{"output that cannot be decoded", func(t *testing.T, c *testChain) {
+			putValue(t, c, utxoBucket, outpointKey(blockAt(t, c, 2).Transactions[0].ID, 0), []byte("junk"))
+		}, 0, verifyUTXO, verifyUTXO, "cannot be decoded"},
+		{"chainstate behind the tip is not repaired", func(t *testing.T, c *testChain) {
+			putValue(t, c, utxoBucket, bestBlockKey, c.tip().PrevBlockHash)
+		}, 0, verifyUTXO, verifyUTXO, "not at the tip"},
+		{"pruned blockchain", func(t *testing.T, c *testChain) {
+			if err := c.bc.EnablePruning(minPruneDepth); err != nil {
+				t.Fatal(err)
+			}
+		}, 0, verifyUTXO, -1, errVerifyPruned.Error()},
+		{"pruned blockchain below the UTXO level", func(t *testing.T, c *testChain) {
+			if err := c.bc.EnablePruning(minPruneDepth); err != nil {
+				t.Fatal(err)
+			}
+		}, 0, verifyTransactions, -1, ""},
+		{"unversioned database", func(t *testing.T, c *testChain) {
+			update(t, c.bc.DB, func(tx StorageTx) error { return tx.DeleteBucket([]byte(metaBucket)) })
+		}, 0, verifyUTXO, -1, "incompatible release"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChain(t, "verify")
+			wallet, payee := newTestWallet()
+			_, miner := newTestWallet()
+			c.mine(miner, c.send(testWallet, payee, 3, 0))
+			c.mine(miner, c.send(wallet, miner, 2, 1))
+			c.mineBlocks(15, miner)
+			if tt.change != nil {
+				tt.change(t, c)
+			}
+
+			c.bc.DB.Close()
+			bc, err := openBlockchainReadOnly(GetDbName(c.nodeID))
+			checked := 0
+			if err == nil {
+				c.bc = bc
+				checked, err = bc.VerifyChain(tt.depth, tt.level)
+			}
+
+			chainErr, _ := err.(*ChainError)
+			switch {
+			case tt.failLevel >= 0:
+				if chainErr == nil || chainErr.Level != tt.failLevel || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Verify: %v, want an inconsistency at level %d with %q", err, tt.failLevel, tt.err)
+				}
+			case tt.err != "":
+				if err == nil || chainErr != nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Verify: %v, want %q", err, tt.err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case tt.depth > 0 && checked != tt.depth:
+				t.Errorf("Checked %d blocks, want %d", checked, tt.depth)
+			}
+		})
+	}
+}
+
+// putValue stores value under key in bucket, deleting the key when value
+// is nil
+func putValue(t *testing.T, c *testChain, bucket string, key, value []byte) {
+	update(t, c.bc.DB, func(tx StorageTx) error {
+		if value == nil {
+			return tx.Bucket([]byte(bucket)).Delete(key)
+		}
+		return tx.Bucket([]byte(bucket)).Put(key, value)
+	})
+}
+
+func blockAt(t *testing.T, c *testChain, height int) *Block {
+	t.Helper()
+
+	block, err := c.bc.GetBlockByHeight(height)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &block
+}
@@ -13,10 +13,7 @@ import (
 	"golang.org/x/crypto/ripemd160"
 )
 
-const (
-	version            = byte(0x00)
-	addressChecksumLen = 4
-)
+const addressChecksumLen = 4
 
 // Wallet stores private and public keys
 type Wallet struct {
@@ -34,7 +31,7 @@ func NewWallet() *Wallet {
 func (w Wallet) GetAddress() []byte {
 	pubKeyHash := HashPubKey(w.PublicKey)
 
-	versionedPayload := append([]byte{version}, pubKeyHash...)
+	versionedPayload := append([]byte{activeNetParams.AddressVersion}, pubKeyHash...)
 	chksum := checksum(versionedPayload)
 
 	fullPayload := append(versionedPayload, chksum...)
@@ -55,15 +52,18 @@ func HashPubKey(pubKey []byte) []byte {
 	return RIPEMD160Hasher.Sum(nil)
 }
 
-// ValidateAddress check if address if valid
+// ValidateAddress check if address if valid and belongs to the active network
 func ValidateAddress(address string) bool {
 	pubKeyHash := Base58Decode([]byte(address))
+	if len(pubKeyHash) <= addressChecksumLen {
+		return false
+	}
 	actualChecksum := pubKeyHash[len(pubKeyHash)-addressChecksumLen:]
 	version := pubKeyHash[0]
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-addressChecksumLen]
 	targetChecksum := checksum(append([]byte{version}, pubKeyHash...))
 
-	return bytes.Equal(actualChecksum, targetChecksum)
+	return version == activeNetParams.AddressVersion && bytes.Equal(actualChecksum, targetChecksum)
 }
 
 // Checksum generates a checksum for a public key
@@ -80,7 +80,9 @@ func newKeyPair() (ecdsa.PrivateKey, []byte) {
 	if err != nil {
 		log.Panic(err)
 	}
-	pubKey := append(priv.PublicKey.X.Bytes(), priv.PublicKey.Y.Bytes()...)
+	// X and Y fill half of the key each, which is how Verify splits it
+	size := (curve.Params().BitSize + 7) / 8
+	pubKey := append(priv.PublicKey.X.FillBytes(make([]byte, size)), priv.PublicKey.Y.FillBytes(make([]byte, size))...)
 
 	return *priv, pubKey
 }